@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"html"
@@ -20,7 +21,7 @@ import (
 	geoip2 "github.com/oschwald/geoip2-golang"
 )
 
-var commands = make(map[string]func(*irc.PrivateMessage))
+var commands = make(map[string]func(*network, *irc.PrivateMessage))
 
 func init() {
 	commands["help"] = help
@@ -35,30 +36,112 @@ func init() {
 	commands["geoip"] = geoip
 	commands["wiki"] = wiki
 	commands["weather"] = weather
+	commands["lag"] = lag
+	commands["uptime"] = uptime
+	commands["whois"] = whois
 }
 
-func help(m *irc.PrivateMessage) {
+func help(n *network, m *irc.PrivateMessage) {
+	settings := n.channel(m.Channel)
 	var coms []string
 	for com := range commands {
-		coms = append(coms, fmt.Sprintf("\"%s\"", com))
+		if settings.commandEnabled(com) {
+			coms = append(coms, fmt.Sprintf("\"%s\"", com))
+		}
 	}
-	if err := client.Send(m.ReplyChannel, fmt.Sprintf("%s commands available: %s", bot.Nick, strings.Join(coms, ", "))); err != nil {
+	if err := n.reply(m, fmt.Sprintf("%s commands available: %s", n.client.Nick(), strings.Join(coms, ", "))); err != nil {
 		log.Printf("could not send message: %v", err)
 	}
-	if err := client.Send(m.ReplyChannel, "Karma can be adjusted thusly: \"foo++\" and \"bar--\""); err != nil {
+	if err := n.reply(m, "Karma can be adjusted thusly: \"foo++\" and \"bar--\""); err != nil {
 		log.Printf("could not send message: %v", err)
 	}
 	log.Println("Shelbot help provided.")
 }
 
-func version(m *irc.PrivateMessage) {
-	if err := client.Send(m.ReplyChannel, fmt.Sprintf("%s version %s.", bot.Nick, Version)); err != nil {
+func version(n *network, m *irc.PrivateMessage) {
+	if err := n.reply(m, fmt.Sprintf("%s version %s.", n.client.Nick(), Version)); err != nil {
 		log.Printf("could not send message: %v", err)
 	}
 	log.Println("Shelbot version " + Version)
 }
 
-func geoip(m *irc.PrivateMessage) {
+func lag(n *network, m *irc.PrivateMessage) {
+	response := "I haven't measured any lag yet; I only check when the server has been quiet for a while."
+	if l := n.client.Lag(); l > 0 {
+		response = fmt.Sprintf("Lag to %s is %s.", n.cfg.Name, l.Round(time.Millisecond))
+	}
+	if err := n.reply(m, response); err != nil {
+		log.Printf("could not send message: %v", err)
+	}
+	log.Println(response)
+}
+
+func uptime(n *network, m *irc.PrivateMessage) {
+	response := fmt.Sprintf("%s has been up for %s", n.client.Nick(), time.Since(startTime).Round(time.Second))
+	if registered := n.client.RegisteredAt(); !registered.IsZero() {
+		response += fmt.Sprintf(", connected to %s for %s", n.cfg.Name, time.Since(registered).Round(time.Second))
+	}
+	response += "."
+	if err := n.reply(m, response); err != nil {
+		log.Printf("could not send message: %v", err)
+	}
+	log.Println(response)
+}
+
+// whoisTimeout bounds how long the whois command waits for the server.
+const whoisTimeout = 10 * time.Second
+
+func whois(n *network, m *irc.PrivateMessage) {
+	lineElements := strings.Fields(m.Text)
+	if len(lineElements) < 2 {
+		if err := n.reply(m, "Please provide a nick."); err != nil {
+			log.Printf("could not send message: %v", err)
+		}
+		return
+	}
+	nick := lineElements[1]
+
+	// The answer is read by the goroutine that delivers messages to
+	// handleMessages, so it has to be waited for elsewhere.
+	go func() {
+		ctx, cancel := context.WithTimeout(n.ctx, whoisTimeout)
+		defer cancel()
+		info, err := n.client.Whois(ctx, nick)
+		var response string
+		if qerr, ok := err.(*irc.QueryError); ok && qerr.Code == 401 {
+			response = fmt.Sprintf("Sorry %s, nobody is using the nick %s.", m.Nick, nick)
+		} else if err != nil {
+			response = fmt.Sprintf("Sorry %s, I couldn't look up %s.", m.Nick, nick)
+			log.Printf("whois %s: %v", nick, err)
+		} else {
+			response = describeWhois(info)
+		}
+		if err := n.reply(m, response); err != nil {
+			log.Printf("could not send message: %v", err)
+		}
+		log.Println(response)
+	}()
+}
+
+// describeWhois sums up a WHOIS answer in a single line.
+func describeWhois(info *irc.WhoisInfo) string {
+	response := fmt.Sprintf("%s is %s@%s (%s)", info.Nick, info.User, info.Host, info.RealName)
+	if info.Account != "" {
+		response += fmt.Sprintf(", logged in as %s", info.Account)
+	}
+	if info.Away != "" {
+		response += fmt.Sprintf(", away: %s", info.Away)
+	}
+	if info.Idle > 0 {
+		response += fmt.Sprintf(", idle for %s", info.Idle)
+	}
+	if len(info.Channels) > 0 {
+		response += fmt.Sprintf(", on %s", strings.Join(info.Channels, " "))
+	}
+	return response + "."
+}
+
+func geoip(n *network, m *irc.PrivateMessage) {
 	db, err := geoip2.Open(filepath.Join(homeDir, "GeoLite2-City.mmdb"))
 	if err != nil {
 		log.Fatal(err)
@@ -66,7 +149,7 @@ func geoip(m *irc.PrivateMessage) {
 	lineElements := strings.Fields(m.Text)
 	if len(lineElements) < 2 {
 		response := fmt.Sprintf("Please provide a value.")
-		if err := client.Send(m.ReplyChannel, response); err != nil {
+		if err := n.reply(m, response); err != nil {
 			log.Printf("could not send message: %v", err)
 		}
 		log.Println(response)
@@ -74,13 +157,13 @@ func geoip(m *irc.PrivateMessage) {
 		ip := net.ParseIP(lineElements[1])
 		if ip == nil {
 			if ips, err := net.LookupIP(lineElements[1]); err != nil || len(ips) == 0 {
-				if err := client.Send(m.ReplyChannel, fmt.Sprintf("I'm sorry %s, %s doesn't seem to be a valid ip address or host", m.Nick, lineElements[1])); err != nil {
+				if err := n.reply(m, fmt.Sprintf("I'm sorry %s, %s doesn't seem to be a valid ip address or host", m.Nick, lineElements[1])); err != nil {
 					log.Printf("could not send message: %v", err)
 				}
 				return
 			} else {
 				ip = ips[0]
-				if err := client.Send(m.ReplyChannel, fmt.Sprintf("Resolved %s to %s", lineElements[1], ip)); err != nil {
+				if err := n.reply(m, fmt.Sprintf("Resolved %s to %s", lineElements[1], ip)); err != nil {
 					log.Printf("could not send message: %v", err)
 				}
 			}
@@ -90,14 +173,14 @@ func geoip(m *irc.PrivateMessage) {
 			log.Fatal(err)
 		}
 		if record == nil {
-			if err := client.Send(m.ReplyChannel, fmt.Sprintf("I'm sorry %s, I couldn't find any information for %s", m.Nick, lineElements[1])); err != nil {
+			if err := n.reply(m, fmt.Sprintf("I'm sorry %s, I couldn't find any information for %s", m.Nick, lineElements[1])); err != nil {
 				log.Printf("could not send message: %v", err)
 			}
 			return
 		}
 		if cityName, ok := record.City.Names["en"]; ok {
 			response := fmt.Sprintf("English city name: %v", cityName)
-			if err := client.Send(m.ReplyChannel, response); err != nil {
+			if err := n.reply(m, response); err != nil {
 				log.Printf("could not send message: %v", err)
 			}
 			log.Println(response)
@@ -105,7 +188,7 @@ func geoip(m *irc.PrivateMessage) {
 		if record.Subdivisions != nil {
 			if subdivName, ok := record.Subdivisions[0].Names["en"]; ok {
 				response := fmt.Sprintf("English subdivision name: %v", subdivName)
-				if err := client.Send(m.ReplyChannel, response); err != nil {
+				if err := n.reply(m, response); err != nil {
 					log.Printf("could not send message: %v", err)
 				}
 				log.Println(response)
@@ -113,14 +196,14 @@ func geoip(m *irc.PrivateMessage) {
 		}
 		if cName, ok := record.Country.Names["en"]; ok {
 			response := fmt.Sprintf("English country name: %v", cName)
-			if err := client.Send(m.ReplyChannel, response); err != nil {
+			if err := n.reply(m, response); err != nil {
 				log.Printf("could not send message: %v", err)
 			}
 			log.Println(response)
 		}
 		if cityName, ok := record.City.Names["ja"]; ok {
 			response := fmt.Sprintf("Japanese city name: %v", cityName)
-			if err := client.Send(m.ReplyChannel, response); err != nil {
+			if err := n.reply(m, response); err != nil {
 				log.Printf("could not send message: %v", err)
 			}
 			log.Println(response)
@@ -128,7 +211,7 @@ func geoip(m *irc.PrivateMessage) {
 		if record.Subdivisions != nil {
 			if subdivName, ok := record.Subdivisions[0].Names["ja"]; ok {
 				response := fmt.Sprintf("Japanese subdivision name: %v", subdivName)
-				if err := client.Send(m.ReplyChannel, response); err != nil {
+				if err := n.reply(m, response); err != nil {
 					log.Printf("could not send message: %v", err)
 				}
 				log.Println(response)
@@ -136,39 +219,39 @@ func geoip(m *irc.PrivateMessage) {
 		}
 		if cName, ok := record.Country.Names["ja"]; ok {
 			response := fmt.Sprintf("Japanese country name: %v", cName)
-			if err := client.Send(m.ReplyChannel, response); err != nil {
+			if err := n.reply(m, response); err != nil {
 				log.Printf("could not send message: %v", err)
 			}
 			log.Println(response)
 		}
 		response := fmt.Sprintf("ISO country code: %v", record.Country.IsoCode)
-		if err := client.Send(m.ReplyChannel, response); err != nil {
+		if err := n.reply(m, response); err != nil {
 			log.Printf("could not send message: %v", err)
 		}
 		log.Println(response)
 		response = fmt.Sprintf("Time zone: %v", record.Location.TimeZone)
-		if err := client.Send(m.ReplyChannel, response); err != nil {
+		if err := n.reply(m, response); err != nil {
 			log.Printf("could not send message: %v", err)
 		}
 		log.Println(response)
 		response = fmt.Sprintf("Coordinates: %v, %v", record.Location.Latitude, record.Location.Longitude)
-		if err := client.Send(m.ReplyChannel, response); err != nil {
+		if err := n.reply(m, response); err != nil {
 			log.Printf("could not send message: %v", err)
 		}
 		log.Println(response)
 		response = fmt.Sprintf("Google Maps: https://www.google.com/maps/@%v,%v,15z", record.Location.Latitude, record.Location.Longitude)
-		if err := client.Send(m.ReplyChannel, response); err != nil {
+		if err := n.reply(m, response); err != nil {
 			log.Printf("could not send message: %v", err)
 		}
 		log.Println(response)
 	}
 }
 
-func convertmph(m *irc.PrivateMessage) {
+func convertmph(n *network, m *irc.PrivateMessage) {
 	lineElements := strings.Fields(m.Text)
 	if len(lineElements) < 2 {
 		response := fmt.Sprintf("Please provide a value.")
-		if err := client.Send(m.ReplyChannel, response); err != nil {
+		if err := n.reply(m, response); err != nil {
 			log.Printf("could not send message: %v", err)
 		}
 		log.Println(response)
@@ -178,18 +261,18 @@ func convertmph(m *irc.PrivateMessage) {
 		kmh := conversions.MPHToKMH(mph)
 
 		response := fmt.Sprintf("%s is %s", mph, kmh)
-		if err := client.Send(m.ReplyChannel, response); err != nil {
+		if err := n.reply(m, response); err != nil {
 			log.Printf("could not send message: %v", err)
 		}
 		log.Println(response)
 	}
 }
 
-func convertkmh(m *irc.PrivateMessage) {
+func convertkmh(n *network, m *irc.PrivateMessage) {
 	lineElements := strings.Fields(m.Text)
 	if len(lineElements) < 2 {
 		response := fmt.Sprintf("Please provide a value.")
-		if err := client.Send(m.ReplyChannel, response); err != nil {
+		if err := n.reply(m, response); err != nil {
 			log.Printf("could not send message: %v", err)
 		}
 		log.Println(response)
@@ -199,18 +282,18 @@ func convertkmh(m *irc.PrivateMessage) {
 		mph := conversions.KMHToMPH(kmh)
 
 		response := fmt.Sprintf("%s is %s", kmh, mph)
-		if err := client.Send(m.ReplyChannel, response); err != nil {
+		if err := n.reply(m, response); err != nil {
 			log.Printf("could not send message: %v", err)
 		}
 		log.Println(response)
 	}
 }
 
-func convertc(m *irc.PrivateMessage) {
+func convertc(n *network, m *irc.PrivateMessage) {
 	lineElements := strings.Fields(m.Text)
 	if len(lineElements) < 2 {
 		response := fmt.Sprintf("Please provide a value.")
-		if err := client.Send(m.ReplyChannel, response); err != nil {
+		if err := n.reply(m, response); err != nil {
 			log.Printf("could not send message: %v", err)
 		}
 		log.Println(response)
@@ -220,18 +303,18 @@ func convertc(m *irc.PrivateMessage) {
 		f := conversions.CelsiusToFahrenheit(c)
 
 		response := fmt.Sprintf("%s is %s", c, f)
-		if err := client.Send(m.ReplyChannel, response); err != nil {
+		if err := n.reply(m, response); err != nil {
 			log.Printf("could not send message: %v", err)
 		}
 		log.Println(response)
 	}
 }
 
-func convertf(m *irc.PrivateMessage) {
+func convertf(n *network, m *irc.PrivateMessage) {
 	lineElements := strings.Fields(m.Text)
 	if len(lineElements) < 2 {
 		response := fmt.Sprintf("Please provide a value.")
-		if err := client.Send(m.ReplyChannel, response); err != nil {
+		if err := n.reply(m, response); err != nil {
 			log.Printf("could not send message: %v", err)
 		}
 		log.Println(response)
@@ -241,20 +324,20 @@ func convertf(m *irc.PrivateMessage) {
 		c := conversions.FahrenheitToCelsius(f)
 
 		response := fmt.Sprintf("%s is %s", f, c)
-		if err := client.Send(m.ReplyChannel, response); err != nil {
+		if err := n.reply(m, response); err != nil {
 			log.Printf("could not send message: %v", err)
 		}
 		log.Println(response)
 	}
 }
 
-func query(m *irc.PrivateMessage) {
+func query(n *network, m *irc.PrivateMessage) {
 	lineElements := strings.Fields(m.Text)
 	if len(lineElements) > 1 {
 		for _, q := range lineElements[1:] {
-			karmaValue := k.query(q)
+			karmaValue := n.karma.query(q)
 			response := fmt.Sprintf("Karma for %s is %d.", q, karmaValue)
-			if err := client.Send(m.ReplyChannel, response); err != nil {
+			if err := n.reply(m, response); err != nil {
 				log.Printf("could not send message: %v", err)
 			}
 			log.Println(response)
@@ -262,12 +345,9 @@ func query(m *irc.PrivateMessage) {
 	}
 }
 
-func ten(m *irc.PrivateMessage) {
+func ten(n *network, m *irc.PrivateMessage) {
 	lineElements := strings.Fields(m.Text)
-	var p []Pair
-	for k, v := range k.db {
-		p = append(p, Pair{k, v})
-	}
+	p := n.karma.pairs()
 
 	switch lineElements[0] {
 	case "topten":
@@ -278,14 +358,14 @@ func ten(m *irc.PrivateMessage) {
 
 	for i := 0; i < 10 && i < len(p); i++ {
 		response := fmt.Sprintf("Karma for %s is %d.", p[i].Key, p[i].Value)
-		if err := client.Send(m.ReplyChannel, response); err != nil {
+		if err := n.reply(m, response); err != nil {
 			log.Printf("could not send message: %v", err)
 		}
 		log.Println(response)
 	}
 }
 
-func wiki(m *irc.PrivateMessage) {
+func wiki(n *network, m *irc.PrivateMessage) {
 	var wikiLookup struct {
 		Batchcomplete string `json:"batchcomplete"`
 		Query         struct {
@@ -312,7 +392,7 @@ func wiki(m *irc.PrivateMessage) {
 
 	resp, err := http.Get("https://en.wikipedia.org/w/api.php?format=json&action=query&prop=extracts|info&redirects&exintro=&inprop=url&explaintext=&titles=" + html.EscapeString(strings.Join(lineElements[1:], "%20")))
 	if err != nil || resp.StatusCode != 200 {
-		if err := client.Send(m.ReplyChannel, fmt.Sprintf("Sorry %s, there was an error looking up a wiki article on %s", m.Nick, strings.Join(lineElements[1:], " "))); err != nil {
+		if err := n.reply(m, fmt.Sprintf("Sorry %s, there was an error looking up a wiki article on %s", m.Nick, strings.Join(lineElements[1:], " "))); err != nil {
 			log.Printf("could not send message: %v", err)
 		}
 		return
@@ -320,23 +400,23 @@ func wiki(m *irc.PrivateMessage) {
 	defer resp.Body.Close()
 	dec := json.NewDecoder(resp.Body)
 	if err := dec.Decode(&wikiLookup); err != nil {
-		if err := client.Send(m.ReplyChannel, fmt.Sprintf("Sorry %s, there was an error looking up a wiki article on %s", m.Nick, strings.Join(lineElements[1:], " "))); err != nil {
+		if err := n.reply(m, fmt.Sprintf("Sorry %s, there was an error looking up a wiki article on %s", m.Nick, strings.Join(lineElements[1:], " "))); err != nil {
 			log.Printf("could not send message: %v", err)
 		}
 		return
 	}
 	for _, entry := range wikiLookup.Query.Pages {
-		if err := client.Send(m.ReplyChannel, strings.Split(entry.Extract, "\n")[0]); err != nil {
+		if err := n.reply(m, strings.Split(entry.Extract, "\n")[0]); err != nil {
 			log.Printf("could not send message: %v", err)
 		}
-		if err := client.Send(m.ReplyChannel, entry.Fullurl); err != nil {
+		if err := n.reply(m, entry.Fullurl); err != nil {
 			log.Printf("could not send message: %v", err)
 		}
 		log.Println("Wikipedia extract provided:", entry.Fullurl)
 	}
 }
 
-func weather(m *irc.PrivateMessage) {
+func weather(n *network, m *irc.PrivateMessage) {
 	lineElements := strings.Fields(m.Text)
 	if apiKey == "" || len(lineElements) < 2 {
 		// need an airport to search for
@@ -347,7 +427,7 @@ func weather(m *irc.PrivateMessage) {
 
 	a := LookupAirport(lineElements[1])
 	if a == nil {
-		if err := client.Send(m.ReplyChannel, fmt.Sprintf("Sorry %s, I couldn't find an airport with that code", m.Nick)); err != nil {
+		if err := n.reply(m, fmt.Sprintf("Sorry %s, I couldn't find an airport with that code", m.Nick)); err != nil {
 			log.Printf("could not send message: %v", err)
 		}
 		return
@@ -357,7 +437,7 @@ func weather(m *irc.PrivateMessage) {
 	c.SetUnits("si")
 	f, err := c.Forecast(a.Latitude, a.Longitude, nil, false)
 	if err != nil || f == nil {
-		if err := client.Send(m.ReplyChannel, fmt.Sprintf("Sorry %s, there was an error looking up the weather for %s", m.Nick, a.Name)); err != nil {
+		if err := n.reply(m, fmt.Sprintf("Sorry %s, there was an error looking up the weather for %s", m.Nick, a.Name)); err != nil {
 			log.Printf("could not send message: %v", err)
 		}
 		log.Println(err)
@@ -365,7 +445,7 @@ func weather(m *irc.PrivateMessage) {
 	}
 
 	response := fmt.Sprintf("The weather at %s is %s and %.1fC", a.Name, f.Currently.Summary, f.Currently.Temperature)
-	if err := client.Send(m.ReplyChannel, response); err != nil {
+	if err := n.reply(m, response); err != nil {
 		log.Printf("could not send message: %v", err)
 	}
 	log.Println(response)
@@ -2,20 +2,103 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"net"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/davidjpeacock/shelbot/irc"
 )
 
+// config is the contents of the configuration file. The settings for a single
+// network may be given at the top level, or several networks can be listed
+// under "networks".
 type config struct {
-	Server        string `json:"server"`
-	Port          uint16 `json:"port"`
-	Nick          string `json:"nick"`
-	User          string `json:"user"`
-	Channel       string `json:"channel"`
-	Pass          string `json:"pass"`
+	networkConfig
+	Networks []*networkConfig `json:"networks"`
+}
+
+type networkConfig struct {
+	Name          string           `json:"name"`
+	Server        string           `json:"server"`
+	Port          uint16           `json:"port"`
+	Nick          string           `json:"nick"`
+	User          string           `json:"user"`
+	Channel       string           `json:"channel"`
+	Channels      []*channelConfig `json:"channels"`
+	Pass          string           `json:"pass"`
+	Account       string           `json:"account"`
+	SASL          string           `json:"sasl"`
+	ServerPass    string           `json:"serverPass"`
+	TLS           tlsConfig        `json:"tls"`
+	AltNicks      []string         `json:"altNicks"`
+	Regain        string           `json:"regain"`
+	KarmaFile     string           `json:"karmaFile"`
+	MaxLines      int              `json:"maxLines"`
+	Notice        bool             `json:"notice"`
+	Colors        *bool            `json:"colors"`
+	MaxAge        int              `json:"maxAge"`
+	Inbox         int              `json:"inbox"`
+	Overflow      string           `json:"overflow"`
 	pread, pwrite chan string
 }
 
+type channelConfig struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
+	// Commands lists the commands available in the channel; all commands
+	// are available if it is empty.
+	Commands []string `json:"commands"`
+	// Karma enables karma tracking in the channel. It defaults to true.
+	Karma *bool `json:"karma"`
+	// Greeting is sent when the bot first joins the channel. A default
+	// greeting is used if it is not set; set it to "" to stay quiet.
+	Greeting *string `json:"greeting"`
+}
+
+// commandEnabled reports whether command may be used in the channel. A nil
+// channelConfig, as used for private messages, allows everything.
+func (ch *channelConfig) commandEnabled(command string) bool {
+	if ch == nil || len(ch.Commands) == 0 {
+		return true
+	}
+	for _, c := range ch.Commands {
+		if c == command {
+			return true
+		}
+	}
+	return false
+}
+
+func (ch *channelConfig) karmaEnabled() bool {
+	return ch == nil || ch.Karma == nil || *ch.Karma
+}
+
+// maxAge is how old a message may be and still be acted on, or zero if
+// there is no limit.
+func (c *networkConfig) maxAge() time.Duration {
+	if c.MaxAge < 0 {
+		return 0
+	}
+	return time.Duration(c.MaxAge) * time.Second
+}
+
+// colorsEnabled reports whether replies may use IRC colors. They are used
+// unless disabled.
+func (c *networkConfig) colorsEnabled() bool {
+	return c.Colors == nil || *c.Colors
+}
+
+type tlsConfig struct {
+	Enabled            bool   `json:"enabled"`
+	CAFile             string `json:"caFile"`
+	CertFile           string `json:"certFile"`
+	KeyFile            string `json:"keyFile"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify"`
+}
+
 func loadConfig(confFile string) (*config, error) {
 	data, err := ioutil.ReadFile(confFile)
 	if err != nil {
@@ -35,9 +118,140 @@ func loadConfig(confFile string) (*config, error) {
 }
 
 func (c *config) validate() error {
-	if !strings.HasPrefix(c.Channel, "#") {
-		c.Channel = "#" + c.Channel
+	if len(c.Networks) == 0 {
+		c.Networks = []*networkConfig{&c.networkConfig}
+	}
+
+	names := make(map[string]bool)
+	for _, n := range c.Networks {
+		if err := n.validate(); err != nil {
+			return fmt.Errorf("network %s: %v", n.Name, err)
+		}
+		if names[n.Name] {
+			return fmt.Errorf("duplicate network name %q", n.Name)
+		}
+		names[n.Name] = true
+	}
+
+	return nil
+}
+
+func (c *networkConfig) validate() error {
+	if c.Server == "" {
+		return fmt.Errorf("no server configured")
+	}
+	if c.Name == "" {
+		c.Name = c.Server
+	}
+
+	if c.Channel != "" {
+		c.Channels = append([]*channelConfig{{Name: c.Channel}}, c.Channels...)
+		c.Channel = ""
+	}
+	for _, ch := range c.Channels {
+		if ch.Name == "" {
+			return fmt.Errorf("channel entry without a name")
+		}
+		if !strings.ContainsAny(ch.Name[:1], "#&!+") {
+			ch.Name = "#" + ch.Name
+		}
+	}
+
+	if c.Port == 0 {
+		c.Port = 6667
+		if c.TLS.Enabled {
+			c.Port = 6697
+		}
+	}
+
+	if c.Account == "" {
+		c.Account = c.Nick
+	}
+
+	if c.MaxAge == 0 {
+		c.MaxAge = 300
+	}
+
+	switch strings.ToLower(c.SASL) {
+	case "", "plain", "external":
+	default:
+		return fmt.Errorf("unsupported SASL mechanism %q", c.SASL)
+	}
+
+	switch strings.ToUpper(c.Regain) {
+	case "", irc.RegainGhost, irc.RegainRegain:
+	default:
+		return fmt.Errorf("unsupported NickServ regain method %q", c.Regain)
+	}
+
+	if _, ok := overflowPolicies[strings.ToLower(c.Overflow)]; !ok {
+		return fmt.Errorf("unsupported overflow policy %q", c.Overflow)
 	}
 
 	return nil
 }
+
+// authOptions returns the irc.Client options needed to authenticate with the
+// configured credentials.
+func (c *networkConfig) authOptions() []irc.Option {
+	var opts []irc.Option
+	switch strings.ToLower(c.SASL) {
+	case "external":
+		opts = append(opts, irc.WithSASLExternal())
+	default:
+		if c.Pass != "" {
+			opts = append(opts, irc.WithSASLPlain(c.Account, c.Pass))
+		}
+	}
+	if c.ServerPass != "" {
+		opts = append(opts, irc.WithServerPassword(c.ServerPass))
+	}
+	if c.Regain != "" && c.Pass != "" {
+		opts = append(opts, irc.WithNickServRegain(c.Regain, c.Pass))
+	}
+	return opts
+}
+
+// overflowPolicies maps the overflow setting to the irc package's policies.
+var overflowPolicies = map[string]irc.OverflowPolicy{
+	"":           irc.DropOldest,
+	"dropoldest": irc.DropOldest,
+	"dropnewest": irc.DropNewest,
+	"block":      irc.Block,
+}
+
+// inboxOption returns the option bounding how many messages may wait to be
+// handled, if one is configured.
+func (c *networkConfig) inboxOption() []irc.Option {
+	if c.Inbox <= 0 && c.Overflow == "" {
+		return nil
+	}
+	size := c.Inbox
+	if size <= 0 {
+		size = irc.DefaultInboxSize
+	}
+	return []irc.Option{irc.WithInbox(size, overflowPolicies[strings.ToLower(c.Overflow)])}
+}
+
+func (c *networkConfig) channelKeys() []irc.ChannelKey {
+	var keys []irc.ChannelKey
+	for _, ch := range c.Channels {
+		keys = append(keys, irc.ChannelKey{Name: ch.Name, Key: ch.Key})
+	}
+	return keys
+}
+
+func (c *networkConfig) address() string {
+	return net.JoinHostPort(c.Server, strconv.Itoa(int(c.Port)))
+}
+
+func (c *networkConfig) dialer() *irc.Dialer {
+	return &irc.Dialer{
+		TLS:                c.TLS.Enabled,
+		CAFile:             c.TLS.CAFile,
+		CertFile:           c.TLS.CertFile,
+		KeyFile:            c.TLS.KeyFile,
+		InsecureSkipVerify: c.TLS.InsecureSkipVerify,
+		Timeout:            30 * time.Second,
+	}
+}
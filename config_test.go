@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/traherom/memstream"
+)
+
+func parseConfig(t *testing.T, conf string) (*config, error) {
+	t.Helper()
+	var c config
+	if err := json.Unmarshal([]byte(conf), &c); err != nil {
+		t.Fatal(err)
+	}
+	return &c, c.validate()
+}
+
+func TestConfigNetworks(t *testing.T) {
+	c, err := parseConfig(t, `{"networks": [
+		{"name": "libera", "server": "irc.libera.chat", "nick": "shelbot", "tls": {"enabled": true}},
+		{"server": "irc.oftc.net", "nick": "shelbot2", "channel": "shelbot"}
+	]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Networks) != 2 {
+		t.Fatalf("got %d networks, want 2", len(c.Networks))
+	}
+
+	libera, oftc := c.Networks[0], c.Networks[1]
+	if libera.Name != "libera" || libera.Port != 6697 || libera.Account != "shelbot" {
+		t.Errorf("libera = %+v", libera)
+	}
+	// Networks without a name are named after their server.
+	if oftc.Name != "irc.oftc.net" || oftc.Port != 6667 || oftc.Nick != "shelbot2" {
+		t.Errorf("oftc = %+v", oftc)
+	}
+	if len(oftc.Channels) != 1 || oftc.Channels[0].Name != "#shelbot" {
+		t.Errorf("oftc channels = %+v", oftc.Channels)
+	}
+}
+
+func TestConfigDuplicateNetworks(t *testing.T) {
+	_, err := parseConfig(t, `{"networks": [
+		{"name": "libera", "server": "irc.libera.chat"},
+		{"name": "libera", "server": "irc.eu.libera.chat"}
+	]}`)
+	if err == nil || !strings.Contains(err.Error(), `duplicate network name "libera"`) {
+		t.Errorf("got error %v, want a duplicate network name", err)
+	}
+
+	// Unnamed networks on the same server clash too.
+	_, err = parseConfig(t, `{"networks": [{"server": "irc.libera.chat"}, {"server": "irc.libera.chat"}]}`)
+	if err == nil {
+		t.Error("accepted two unnamed networks on the same server")
+	}
+}
+
+func TestConfigSingleNetwork(t *testing.T) {
+	c, err := parseConfig(t, `{"server": "irc.libera.chat", "nick": "shelbot", "channel": "#shelbot", "karmaFile": "libera.json"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Networks) != 1 || c.Networks[0] != &c.networkConfig {
+		t.Fatalf("networks = %+v, want the top level settings", c.Networks)
+	}
+	n := c.Networks[0]
+	if n.Name != "irc.libera.chat" || n.Nick != "shelbot" || n.KarmaFile != "libera.json" || len(n.Channels) != 1 {
+		t.Errorf("network = %+v", n)
+	}
+
+	if _, err := parseConfig(t, `{"nick": "shelbot"}`); err == nil {
+		t.Error("accepted a config without a server")
+	}
+}
+
+func TestOpenKarma(t *testing.T) {
+	c, err := parseConfig(t, `{"networks": [
+		{"name": "a", "server": "irc.a.net", "karmaFile": "shared.json"},
+		{"name": "b", "server": "irc.b.net"},
+		{"name": "c", "server": "irc.c.net", "karmaFile": "shared.json"},
+		{"name": "d", "server": "irc.d.net"},
+		{"name": "e", "server": "irc.e.net", "karmaFile": "e.json"}
+	]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var opened []string
+	karmas, err := openKarma(c.Networks, "default.json", func(file string) (*karma, error) {
+		opened = append(opened, file)
+		return newKarma(memstream.New()), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(opened, " "), "shared.json default.json e.json"; got != want {
+		t.Errorf("opened %s, want %s", got, want)
+	}
+	if karmas[0] != karmas[2] || karmas[1] != karmas[3] {
+		t.Error("networks with the same karma file do not share it")
+	}
+	if karmas[0] == karmas[1] || karmas[0] == karmas[4] || karmas[1] == karmas[4] {
+		t.Error("networks with different karma files share one")
+	}
+}
@@ -0,0 +1,64 @@
+package irc
+
+import "time"
+
+// Batch types that hold history being played back, e.g. by a bouncer after
+// reconnecting, rather than messages sent just now.
+const (
+	BatchChatHistory = "chathistory"
+	BatchZNCPlayback = "znc.in/playback"
+)
+
+// Time returns when the message was sent according to the server-time tag,
+// if it has one.
+func (m *Message) Time() (time.Time, bool) {
+	value, ok := m.Tags["time"]
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+func isPlaybackBatch(batchType string) bool {
+	return batchType == BatchChatHistory || batchType == BatchZNCPlayback
+}
+
+// handleBatch tracks open batches. Params are +<ref> <type> [<params>...]
+// to start a batch and -<ref> to end it.
+func (c *Client) handleBatch(_ *Client, m *Message) {
+	ref := m.Param(0)
+	if len(ref) < 2 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch ref[0] {
+	case '+':
+		batchType := m.Param(1)
+		// Batches nested in playback are part of the playback.
+		if parent, ok := c.batches[m.Tags["batch"]]; ok && isPlaybackBatch(parent) {
+			batchType = parent
+		}
+		if c.batches == nil {
+			c.batches = make(map[string]string)
+		}
+		c.batches[ref[1:]] = batchType
+	case '-':
+		delete(c.batches, ref[1:])
+	}
+}
+
+// inPlayback reports whether m belongs to a playback batch.
+func (c *Client) inPlayback(m *Message) bool {
+	ref, ok := m.Tags["batch"]
+	if !ok {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return isPlaybackBatch(c.batches[ref])
+}
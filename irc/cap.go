@@ -0,0 +1,145 @@
+package irc
+
+import (
+	"sort"
+	"strings"
+)
+
+// Capabilities commonly requested from IRCv3 servers.
+const (
+	CapServerTime    = "server-time"
+	CapAccountTag    = "account-tag"
+	CapAccountNotify = "account-notify"
+	CapMessageTags   = "message-tags"
+	CapMultiPrefix   = "multi-prefix"
+	CapAwayNotify    = "away-notify"
+	CapExtendedJoin  = "extended-join"
+	CapBatch         = "batch"
+)
+
+// WithCapabilities declares the IRCv3 capabilities the client would like to
+// use. Capabilities the server does not advertise are silently skipped.
+func WithCapabilities(caps ...string) Option {
+	return func(c *Client) { c.wantCaps = append(c.wantCaps, caps...) }
+}
+
+// HasCapability reports whether the server acknowledged the capability.
+func (c *Client) HasCapability(name string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.caps[name]
+}
+
+// Capabilities returns the sorted list of capabilities granted by the server.
+func (c *Client) Capabilities() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var caps []string
+	for name, ok := range c.caps {
+		if ok {
+			caps = append(caps, name)
+		}
+	}
+	sort.Strings(caps)
+	return caps
+}
+
+func (c *Client) startCapNegotiation() error {
+	c.mu.Lock()
+	c.caps = make(map[string]bool)
+	c.availableCaps = make(map[string]string)
+	c.mu.Unlock()
+	return c.send("CAP LS 302")
+}
+
+// handleCap processes CAP replies during and after registration. Params are
+// <target> <subcommand> [*] :<capabilities>.
+func (c *Client) handleCap(m *Message) {
+	if len(m.Params) < 3 {
+		return
+	}
+	sub := strings.ToUpper(m.Params[1])
+	list := m.Params[len(m.Params)-1]
+	more := len(m.Params) > 3 && m.Params[2] == "*"
+
+	switch sub {
+	case "LS", "NEW":
+		c.mu.Lock()
+		for _, tok := range strings.Fields(list) {
+			kv := strings.SplitN(tok, "=", 2)
+			c.availableCaps[kv[0]] = ""
+			if len(kv) == 2 {
+				c.availableCaps[kv[0]] = kv[1]
+			}
+		}
+		c.mu.Unlock()
+		if !more {
+			c.requestCaps()
+		}
+	case "ACK":
+		c.mu.Lock()
+		for _, name := range strings.Fields(list) {
+			if strings.HasPrefix(name, "-") {
+				delete(c.caps, name[1:])
+				continue
+			}
+			c.caps[name] = true
+		}
+		c.mu.Unlock()
+		c.logger.Println("Capabilities acknowledged:", list)
+		if more {
+			return
+		}
+		c.mu.Lock()
+		done := c.capsDone
+		c.mu.Unlock()
+		if !done && c.saslSupported() {
+			c.startSASL()
+			return
+		}
+		c.finishCaps()
+	case "NAK":
+		c.logger.Println("Capabilities rejected:", list)
+		if !more {
+			c.finishCaps()
+		}
+	case "DEL":
+		c.mu.Lock()
+		for _, name := range strings.Fields(list) {
+			delete(c.caps, name)
+			delete(c.availableCaps, name)
+		}
+		c.mu.Unlock()
+	}
+}
+
+// requestCaps sends CAP REQ for every wanted capability the server offers
+// and has not granted yet, or ends negotiation if there is nothing to ask.
+func (c *Client) requestCaps() {
+	c.mu.Lock()
+	var req []string
+	for _, name := range c.wantCaps {
+		if _, ok := c.availableCaps[name]; ok && !c.caps[name] {
+			req = append(req, name)
+		}
+	}
+	c.mu.Unlock()
+
+	if len(req) == 0 {
+		c.finishCaps()
+		return
+	}
+	c.send("CAP REQ :%s", strings.Join(req, " "))
+}
+
+// finishCaps ends capability negotiation, allowing registration to complete.
+// After registration it is a no-op as CAP END is only valid once.
+func (c *Client) finishCaps() {
+	c.mu.Lock()
+	done := c.capsDone
+	c.capsDone = true
+	c.mu.Unlock()
+	if !done {
+		c.send("CAP END")
+	}
+}
@@ -0,0 +1,550 @@
+package irc_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/davidjpeacock/shelbot/irc"
+	"github.com/davidjpeacock/shelbot/irc/irctest"
+)
+
+// connect starts a client on a fake server and registers it as shelbot.
+func connect(t *testing.T, opts ...irc.Option) (*irc.Client, *irctest.Server) {
+	t.Helper()
+	server, conn := irctest.NewServer(t)
+	client := irc.New(conn, opts...)
+
+	errc := make(chan error, 1)
+	go func() { errc <- client.Run(context.Background()) }()
+	t.Cleanup(func() {
+		client.Quit("")
+		if err := <-errc; err != nil {
+			t.Errorf("Run returned %v", err)
+		}
+	})
+
+	if err := client.Connect("shelbot", "Shel Bot"); err != nil {
+		t.Fatal(err)
+	}
+	server.Register()
+	select {
+	case <-client.Registered():
+	case <-time.After(time.Second):
+		t.Fatal("client did not register")
+	}
+	return client, server
+}
+
+func TestRegister(t *testing.T) {
+	server, conn := irctest.NewServer(t)
+	server.Caps = []string{"multi-prefix", "sasl", "server-time"}
+	client := irc.New(conn,
+		irc.WithCapabilities(irc.CapMultiPrefix, irc.CapServerTime, irc.CapAwayNotify),
+		irc.WithSASLPlain("shelbot", "hunter2"),
+	)
+	go client.Run(context.Background())
+	defer server.Close()
+	defer client.Quit("")
+
+	if err := client.Connect("shelbot", "Shel Bot"); err != nil {
+		t.Fatal(err)
+	}
+
+	server.Expect("CAP", "LS", "302")
+	server.Expect("USER", "shelbot")
+	server.Expect("NICK", "shelbot")
+	server.Sendf(":%s CAP * LS :multi-prefix sasl server-time", irctest.ServerName)
+	if m := server.Expect("CAP", "REQ"); m.Param(1) != "multi-prefix server-time sasl" {
+		t.Errorf("requested %q", m.Param(1))
+	}
+	server.Sendf(":%s CAP * ACK :multi-prefix sasl server-time", irctest.ServerName)
+	server.Expect("AUTHENTICATE", "PLAIN")
+	server.Send("AUTHENTICATE +")
+	if m := server.Expect("AUTHENTICATE"); m.Param(0) != "c2hlbGJvdABzaGVsYm90AGh1bnRlcjI=" {
+		t.Errorf("credentials %q", m.Param(0))
+	}
+	server.Numeric(900, irctest.Mask("shelbot"), "shelbot", "You are now logged in as shelbot")
+	server.Numeric(903, "SASL authentication successful")
+	server.Expect("CAP", "END")
+	server.Numeric(1, "Welcome")
+
+	select {
+	case <-client.Registered():
+	case <-time.After(time.Second):
+		t.Fatal("client did not register")
+	}
+	if got := client.Account(); got != "shelbot" {
+		t.Errorf("Account() = %q, want shelbot", got)
+	}
+	if !client.HasCapability(irc.CapServerTime) || client.HasCapability(irc.CapAwayNotify) {
+		t.Errorf("Capabilities() = %v", client.Capabilities())
+	}
+}
+
+func TestUnrequestedCaps(t *testing.T) {
+	client, server := connect(t)
+	server.Sendf(":%s CAP shelbot NEW :away-notify", irctest.ServerName)
+	server.Sendf(":%s CAP shelbot LS :multi-prefix", irctest.ServerName)
+	server.Sendf(":%s CAP shelbot ACK :multi-prefix", irctest.ServerName)
+	server.Ping("sync")
+	if !client.HasCapability(irc.CapMultiPrefix) {
+		t.Errorf("Capabilities() = %v", client.Capabilities())
+	}
+}
+
+func TestPing(t *testing.T) {
+	_, server := connect(t)
+	server.Ping("irc.example.net")
+	server.Ping("12345")
+}
+
+func TestKeepaliveLag(t *testing.T) {
+	client, server := connect(t, irc.WithKeepalive(50*time.Millisecond, time.Second))
+	ping := server.Expect("PING")
+	time.Sleep(10 * time.Millisecond)
+	server.Sendf(":%s PONG %s :%s", irctest.ServerName, irctest.ServerName, ping.Param(0))
+	server.Ping("sync")
+	if lag := client.Lag(); lag < 10*time.Millisecond || lag > time.Second {
+		t.Errorf("Lag() = %s, want about 10ms", lag)
+	}
+}
+
+func TestKeepaliveTimeout(t *testing.T) {
+	server, conn := irctest.NewServer(t)
+	defer server.Close()
+	client := irc.New(conn, irc.WithKeepalive(50*time.Millisecond, 50*time.Millisecond))
+	errc := make(chan error, 1)
+	go func() { errc <- client.Run(context.Background()) }()
+	defer client.Quit("")
+
+	client.Connect("shelbot", "Shel Bot")
+	server.Register()
+	server.Expect("PING")
+	select {
+	case err := <-errc:
+		if err != irc.ErrPingTimeout {
+			t.Errorf("Run returned %v, want %v", err, irc.ErrPingTimeout)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Run did not time out without a PONG")
+	}
+}
+
+func TestPrivateMessages(t *testing.T) {
+	client, server := connect(t)
+	for _, want := range []irc.PrivateMessage{
+		{Nick: "alice", Channel: "#shelbot", ReplyChannel: "#shelbot", Text: "hello there"},
+		{Nick: "bob", Channel: "shelbot", ReplyChannel: "bob", Text: "hi"},
+	} {
+		server.Privmsg(want.Nick, want.Channel, want.Text)
+		select {
+		case got := <-client.PrivateMessages():
+			if got.Nick != want.Nick || got.Channel != want.Channel || got.ReplyChannel != want.ReplyChannel || got.Text != want.Text {
+				t.Errorf("got %+v, want %+v", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no message for %+v", want)
+		}
+	}
+}
+
+func TestSend(t *testing.T) {
+	client, server := connect(t, irc.WithRateLimit(10, time.Millisecond))
+	client.Send(context.Background(), "#shelbot", "first\nsecond")
+	server.Expect("PRIVMSG", "#shelbot", "first")
+	server.Expect("PRIVMSG", "#shelbot", "second")
+
+	client.Notice(context.Background(), "alice", "psst")
+	server.Expect("NOTICE", "alice", "psst")
+}
+
+func TestReplyTo(t *testing.T) {
+	server, conn := irctest.NewServer(t)
+	server.Caps = []string{irc.CapMessageTags}
+	client := irc.New(conn, irc.WithCapabilities(irc.CapMessageTags))
+	go client.Run(context.Background())
+	defer server.Close()
+	defer client.Quit("")
+
+	client.Connect("shelbot", "Shel Bot")
+	server.Register()
+	server.Sendf("@msgid=abc;time=2017-03-01T12:00:00.000Z :%s PRIVMSG #shelbot :hi", irctest.Mask("alice"))
+	select {
+	case p := <-client.PrivateMessages():
+		if p.ID != "abc" {
+			t.Errorf("ID = %q, want abc", p.ID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no message")
+	}
+
+	client.Action(context.Background(), "#shelbot", "waves", irc.ReplyTo("abc"))
+	if m := server.Expect("PRIVMSG", "#shelbot", "\x01ACTION waves\x01"); m.Tags["+draft/reply"] != "abc" {
+		t.Errorf("got %q, want a reply to abc", m)
+	}
+}
+
+func TestReplyToUnsupported(t *testing.T) {
+	client, server := connect(t)
+	client.Send(context.Background(), "#shelbot", "hello", irc.ReplyTo("abc"))
+	if m := server.Expect("PRIVMSG", "#shelbot", "hello"); len(m.Tags) != 0 {
+		t.Errorf("got %q, want no tags without message-tags", m)
+	}
+}
+
+func TestSendExpired(t *testing.T) {
+	client, server := connect(t, irc.WithRateLimit(1, 200*time.Millisecond))
+	ctx, cancel := context.WithCancel(context.Background())
+	client.Send(ctx, "#shelbot", "one\ntwo\nthree")
+	server.Expect("PRIVMSG", "#shelbot", "one")
+	// The rest are held back by flood control.
+	cancel()
+	client.Send(context.Background(), "#shelbot", "four")
+
+	if m := server.Next(); m.Param(1) != "four" {
+		t.Errorf("got %q, want the expired lines to be dropped", m)
+	}
+}
+
+func TestRunCancel(t *testing.T) {
+	server, conn := irctest.NewServer(t)
+	defer server.Close()
+	client := irc.New(conn)
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- client.Run(ctx) }()
+
+	cancel()
+	select {
+	case err := <-errc:
+		if err != context.Canceled {
+			t.Errorf("Run returned %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return after cancel")
+	}
+	if _, ok := <-client.PrivateMessages(); ok {
+		t.Error("PrivateMessages is still open")
+	}
+	if _, ok := <-client.Messages(); ok {
+		t.Error("Messages is still open")
+	}
+}
+
+func TestCTCP(t *testing.T) {
+	_, server := connect(t, irc.WithVersion("shelbot test"))
+	server.Privmsg("alice", "shelbot", "\x01VERSION\x01")
+	server.Expect("NOTICE", "alice", "\x01VERSION shelbot test\x01")
+	server.Privmsg("alice", "shelbot", "\x01PING 1234\x01")
+	server.Expect("NOTICE", "alice", "\x01PING 1234\x01")
+}
+
+func TestNickInUse(t *testing.T) {
+	server, conn := irctest.NewServer(t)
+	client := irc.New(conn, irc.WithAltNicks("shelbot2"))
+	go client.Run(context.Background())
+	defer server.Close()
+	defer client.Quit("")
+
+	client.Connect("shelbot", "Shel Bot")
+	server.Expect("NICK", "shelbot")
+	server.Numeric(433, "shelbot", "Nickname is already in use")
+	server.Expect("NICK", "shelbot2")
+	server.Numeric(433, "shelbot2", "Nickname is already in use")
+	server.Expect("NICK", "shelbot_")
+}
+
+func TestChannelTraffic(t *testing.T) {
+	client, server := connect(t)
+	client.Join("#shelbot", "")
+	server.Expect("JOIN", "#shelbot")
+
+	server.Join("shelbot", "#shelbot")
+	server.Numeric(353, "=", "#shelbot", "shelbot @alice +bob")
+	server.Numeric(366, "#shelbot", "End of /NAMES list")
+	server.Join("carol", "#shelbot")
+	server.Sendf(":%s MODE #shelbot +v carol", irctest.Mask("alice"))
+	server.Ping("sync")
+
+	if !client.IsOp("#shelbot", "alice") || !client.IsVoiced("#shelbot", "carol") || client.IsOp("#shelbot", "bob") {
+		t.Errorf("members = %+v", client.Members("#shelbot"))
+	}
+	if got := len(client.Members("#SHELBOT")); got != 4 {
+		t.Errorf("got %d members, want 4", got)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	client, server := connect(t)
+	events := make(chan interface{}, 16)
+	client.OnJoin(func(_ *irc.Client, e *irc.Join) { events <- *e })
+	client.OnPart(func(_ *irc.Client, e *irc.Part) { events <- *e })
+	client.OnKick(func(_ *irc.Client, e *irc.Kick) { events <- *e })
+	client.OnQuit(func(_ *irc.Client, e *irc.Quit) { events <- *e })
+	client.OnNick(func(_ *irc.Client, e *irc.NickChange) { events <- *e })
+	client.OnMode(func(_ *irc.Client, e *irc.Mode) { events <- *e })
+	client.OnTopic(func(_ *irc.Client, e *irc.Topic) { events <- *e })
+	client.OnNumeric(42, func(_ *irc.Client, m *irc.Message) { events <- m.Command + " " + m.Param(1) })
+
+	alice := irc.Source{Nick: "alice", User: "~alice", Host: "example.com"}
+	server.Sendf(":%s JOIN #shelbot", irctest.Mask("alice"))
+	server.Sendf(":%s PART #shelbot :gone fishing", irctest.Mask("alice"))
+	server.Sendf(":%s KICK #shelbot bob :no spamming", irctest.Mask("alice"))
+	server.Sendf(":%s QUIT", irctest.Mask("alice"))
+	server.Sendf(":%s NICK :alicia", irctest.Mask("alice"))
+	server.Sendf(":%s MODE #shelbot +ov bob carol", irctest.Mask("alice"))
+	server.Sendf(":%s MODE #shelbot +m", irctest.Mask("alice"))
+	server.Sendf(":%s TOPIC #shelbot :Karma for all", irctest.Mask("alice"))
+	server.Numeric(42, "the answer")
+	server.Numeric(420, "not the answer")
+	server.Ping("sync")
+	close(events)
+
+	want := []interface{}{
+		irc.Join{Source: alice, Channel: "#shelbot"},
+		irc.Part{Source: alice, Channel: "#shelbot", Reason: "gone fishing"},
+		irc.Kick{Source: alice, Channel: "#shelbot", Nick: "bob", Reason: "no spamming"},
+		irc.Quit{Source: alice},
+		irc.NickChange{Source: alice, NewNick: "alicia"},
+		irc.Mode{Source: alice, Target: "#shelbot", Modes: "+ov", Args: []string{"bob", "carol"}},
+		irc.Mode{Source: alice, Target: "#shelbot", Modes: "+m"},
+		irc.Topic{Source: alice, Channel: "#shelbot", Topic: "Karma for all"},
+		"042 the answer",
+	}
+	var got []interface{}
+	for e := range events {
+		got = append(got, e)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got events\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	var recording bytes.Buffer
+	client, server := connect(t, irc.WithRecorder(&recording), irc.WithServerPassword("hunter2"))
+	server.Privmsg("alice", "shelbot", "\x01VERSION\x01")
+	server.Expect("NOTICE", "alice")
+	client.Send(context.Background(), "#shelbot", "hello")
+	server.Expect("PRIVMSG", "#shelbot", "hello")
+	client.Quit("")
+
+	if !strings.Contains(recording.String(), ">> PASS <redacted>\n") || strings.Contains(recording.String(), "hunter2") {
+		t.Errorf("password not redacted in recording:\n%s", recording.String())
+	}
+
+	replay, err := irc.NewReplay(&recording)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed := irc.New(replay)
+	if err := replayed.Run(context.Background()); err != io.EOF {
+		t.Fatalf("Run returned %v, want %v", err, io.EOF)
+	}
+	if err := replayed.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := replayed.Nick(); got != "shelbot" {
+		t.Errorf("Nick() = %q after replay, want shelbot", got)
+	}
+	written := replay.Written()
+	if len(written) != 1 || !strings.HasPrefix(written[0], "NOTICE alice :\x01VERSION ") {
+		t.Errorf("replayed client sent %q, want the VERSION reply", written)
+	}
+}
+
+func TestNewReplayErrors(t *testing.T) {
+	for _, recording := range []string{
+		"PING :irc.example.net\n",
+		"yesterday << PING :irc.example.net\n",
+		"2017-03-01T12:00:00.000Z <> PING :irc.example.net\n",
+	} {
+		if _, err := irc.NewReplay(strings.NewReader(recording)); err == nil {
+			t.Errorf("NewReplay(%q) succeeded", recording)
+		}
+	}
+}
+
+func TestStripFormatting(t *testing.T) {
+	client, server := connect(t, irc.WithStripFormatting())
+	server.Privmsg("alice", "#shelbot", "\x02bob\x02++ \x0304,01red\x03")
+	select {
+	case p := <-client.PrivateMessages():
+		if p.Text != "bob++ red" {
+			t.Errorf("Text = %q, want %q", p.Text, "bob++ red")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no message")
+	}
+}
+
+func TestPlayback(t *testing.T) {
+	client, server := connect(t)
+	next := func() *irc.PrivateMessage {
+		t.Helper()
+		select {
+		case p := <-client.PrivateMessages():
+			return p
+		case <-time.After(time.Second):
+			t.Fatal("no message")
+		}
+		return nil
+	}
+
+	server.Sendf(":%s BATCH +hist chathistory #shelbot", irctest.ServerName)
+	server.Sendf("@batch=hist;time=2017-03-01T12:00:00.000Z :%s PRIVMSG #shelbot :old++", irctest.Mask("alice"))
+	p := next()
+	if want := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC); !p.Playback || !p.Time.Equal(want) {
+		t.Errorf("got playback %v at %v, want playback at %v", p.Playback, p.Time, want)
+	}
+
+	server.Sendf(":%s BATCH -hist", irctest.ServerName)
+	server.Privmsg("alice", "#shelbot", "new++")
+	p = next()
+	if p.Playback || time.Since(p.Time) > time.Second {
+		t.Errorf("got playback %v at %v, want a live message", p.Playback, p.Time)
+	}
+}
+
+func TestWhois(t *testing.T) {
+	client, server := connect(t)
+	type result struct {
+		info *irc.WhoisInfo
+		err  error
+	}
+	whois := func(nick string) <-chan result {
+		c := make(chan result, 1)
+		go func() {
+			info, err := client.Whois(context.Background(), nick)
+			c <- result{info, err}
+		}()
+		server.Expect("WHOIS", nick)
+		return c
+	}
+	alice, nobody := whois("alice"), whois("nobody")
+
+	server.Numeric(311, "Alice", "~a", "example.com", "*", "Alice Liddell")
+	server.Numeric(319, "Alice", "@#ops #shelbot")
+	server.Numeric(312, "Alice", irctest.ServerName, "Example server")
+	server.Numeric(317, "Alice", "300", "1488369600", "seconds idle, signon time")
+	server.Numeric(330, "Alice", "alice", "is logged in as")
+	server.Numeric(318, "Alice", "End of /WHOIS list")
+	server.Numeric(401, "nobody", "No such nick/channel")
+	server.Numeric(318, "nobody", "End of /WHOIS list")
+
+	r := <-alice
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if r.info.Nick != "Alice" || r.info.Host != "example.com" || r.info.Account != "alice" || r.info.Idle != 5*time.Minute || len(r.info.Channels) != 2 {
+		t.Errorf("got %+v", r.info)
+	}
+	r = <-nobody
+	if err, ok := r.err.(*irc.QueryError); !ok || err.Code != 401 {
+		t.Errorf("got error %v, want ERR_NOSUCHNICK", r.err)
+	}
+}
+
+func TestWho(t *testing.T) {
+	client, server := connect(t)
+	done := make(chan []irc.WhoReply)
+	go func() {
+		replies, err := client.Who(context.Background(), "#shelbot")
+		if err != nil {
+			t.Error(err)
+		}
+		done <- replies
+	}()
+	server.Expect("WHO", "#shelbot")
+	server.Numeric(352, "#shelbot", "~a", "example.com", irctest.ServerName, "alice", "H*@", "0 Alice Liddell")
+	server.Numeric(352, "#shelbot", "~b", "example.com", irctest.ServerName, "bob", "G", "1 Bob")
+	server.Numeric(315, "#shelbot", "End of /WHO list")
+
+	replies := <-done
+	if len(replies) != 2 {
+		t.Fatalf("got %d replies, want 2", len(replies))
+	}
+	if r := replies[0]; r.Nick != "alice" || !r.Operator || r.Prefix != "@" || r.Away || r.RealName != "Alice Liddell" {
+		t.Errorf("got %+v for alice", r)
+	}
+	if r := replies[1]; r.Nick != "bob" || !r.Away || r.Hops != 1 {
+		t.Errorf("got %+v for bob", r)
+	}
+}
+
+func TestTopicAndModes(t *testing.T) {
+	client, server := connect(t)
+	errc := make(chan error, 1)
+	go func() {
+		topic, err := client.Topic(context.Background(), "#shelbot")
+		if err == nil && topic != "Karma for all" {
+			err = fmt.Errorf("Topic() = %q", topic)
+		}
+		errc <- err
+	}()
+	server.Expect("TOPIC", "#shelbot")
+	server.Numeric(332, "#shelbot", "Karma for all")
+	if err := <-errc; err != nil {
+		t.Error(err)
+	}
+
+	go func() {
+		mode, err := client.ChannelModes(context.Background(), "#shelbot")
+		if err == nil && (mode.Modes != "+ntl" || len(mode.Args) != 1) {
+			err = fmt.Errorf("ChannelModes() = %+v", mode)
+		}
+		errc <- err
+	}()
+	server.Expect("MODE", "#shelbot")
+	server.Numeric(324, "#shelbot", "+ntl", "50")
+	if err := <-errc; err != nil {
+		t.Error(err)
+	}
+
+	go func() {
+		_, err := client.Topic(context.Background(), "#nowhere")
+		errc <- err
+	}()
+	server.Expect("TOPIC", "#nowhere")
+	server.Numeric(403, "#nowhere", "No such channel")
+	if err := <-errc; err == nil {
+		t.Error("Topic() of a missing channel succeeded")
+	}
+}
+
+func TestQueryTimeout(t *testing.T) {
+	client, server := connect(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := client.Whois(ctx, "alice"); err != context.DeadlineExceeded {
+		t.Errorf("Whois returned %v, want %v", err, context.DeadlineExceeded)
+	}
+	server.Expect("WHOIS", "alice")
+}
+
+func TestSlowReader(t *testing.T) {
+	client, server := connect(t, irc.WithInbox(1, irc.DropNewest))
+	for _, text := range []string{"zero", "one", "two", "three", "four"} {
+		server.Privmsg("alice", "#shelbot", text)
+	}
+	// PINGs are answered although nobody reads PrivateMessages.
+	server.Ping("sync")
+
+	if stats := client.InboxStats(); stats.Dropped < 3 {
+		t.Errorf("InboxStats() = %+v, want at least 3 dropped", stats)
+	}
+	select {
+	case p := <-client.PrivateMessages():
+		if p.Text != "zero" {
+			t.Errorf("got %q, want the first message", p.Text)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no message")
+	}
+}
@@ -0,0 +1,71 @@
+package irc
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+const ctcpDelim = "\x01"
+
+// CTCP is a client-to-client protocol request embedded in a PRIVMSG, or a
+// reply embedded in a NOTICE, e.g. "\x01ACTION waves\x01".
+type CTCP struct {
+	Command string
+	Params  string
+}
+
+// WithVersion sets the reply to CTCP VERSION queries.
+func WithVersion(version string) Option {
+	return func(c *Client) { c.version = version }
+}
+
+// decodeCTCP extracts a CTCP message from text. The closing delimiter is
+// optional as some clients leave it out.
+func decodeCTCP(text string) (*CTCP, bool) {
+	if !strings.HasPrefix(text, ctcpDelim) {
+		return nil, false
+	}
+	text = strings.TrimSuffix(text[1:], ctcpDelim)
+	command, params := nextToken(text)
+	if command == "" {
+		return nil, false
+	}
+	return &CTCP{Command: strings.ToUpper(command), Params: params}, true
+}
+
+func encodeCTCP(command, params string) string {
+	if params == "" {
+		return ctcpDelim + command + ctcpDelim
+	}
+	return ctcpDelim + command + " " + params + ctcpDelim
+}
+
+// Action queues text to be sent to target as a CTCP ACTION, like /me,
+// dropping lines still queued when ctx is done.
+func (c *Client) Action(ctx context.Context, target string, text string, opts ...SendOption) error {
+	return c.sendText(ctx, "PRIVMSG", target, text, ctcpDelim+"ACTION ", ctcpDelim, opts...)
+}
+
+// replyCTCP answers the CTCP queries the client handles itself. It reports
+// whether the query was answered.
+func (c *Client) replyCTCP(p *PrivateMessage) bool {
+	var reply string
+	switch p.CTCP.Command {
+	case "VERSION":
+		reply = c.version
+	case "PING":
+		reply = p.CTCP.Params
+	case "TIME":
+		reply = time.Now().Format(time.RFC1123Z)
+	case "CLIENTINFO":
+		reply = "ACTION CLIENTINFO PING TIME VERSION"
+	default:
+		return false
+	}
+	c.logger.Printf("Answering CTCP %s from %s", p.CTCP.Command, p.Nick)
+	if err := c.sendText(context.Background(), "NOTICE", p.Nick, reply, ctcpDelim+p.CTCP.Command+" ", ctcpDelim); err != nil {
+		c.logger.Println("Error answering CTCP:", err)
+	}
+	return true
+}
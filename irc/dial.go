@@ -0,0 +1,83 @@
+package irc
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+// Dialer establishes connections to IRC servers, optionally over TLS.
+type Dialer struct {
+	// TLS enables TLS on the connection.
+	TLS bool
+	// CAFile is a PEM bundle of certificate authorities used instead of the
+	// system roots to verify the server.
+	CAFile string
+	// CertFile and KeyFile are a PEM client certificate and key presented to
+	// the server, e.g. for CertFP and SASL EXTERNAL.
+	CertFile string
+	KeyFile  string
+	// InsecureSkipVerify disables server certificate verification. It should
+	// only be used against test servers.
+	InsecureSkipVerify bool
+	// Timeout bounds how long establishing the connection may take.
+	Timeout time.Duration
+}
+
+// Dial connects to addr, which must be in host:port form.
+func (d *Dialer) Dial(addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), addr)
+}
+
+// DialContext connects to addr, giving up when ctx is done.
+func (d *Dialer) DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	nd := &net.Dialer{Timeout: d.Timeout}
+	if !d.TLS {
+		return nd.DialContext(ctx, "tcp", addr)
+	}
+
+	config, err := d.tlsConfig(addr)
+	if err != nil {
+		return nil, err
+	}
+	return (&tls.Dialer{NetDialer: nd, Config: config}).DialContext(ctx, "tcp", addr)
+}
+
+func (d *Dialer) tlsConfig(addr string) (*tls.Config, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: d.InsecureSkipVerify,
+	}
+
+	if d.CAFile != "" {
+		pem, err := ioutil.ReadFile(d.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA bundle: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in CA bundle " + d.CAFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if d.CertFile != "" || d.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(d.CertFile, d.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
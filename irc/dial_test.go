@@ -0,0 +1,170 @@
+package irc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self-signed certificate for 127.0.0.1 and its key to
+// dir as name.pem and name.key, and returns their paths.
+func writeCert(t *testing.T, dir, name string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile = filepath.Join(dir, name+".pem")
+	keyFile = filepath.Join(dir, name+".key")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	return certFile, keyFile
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "shelbot-dial")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	serverCert, _ := writeCert(t, dir, "server")
+	clientCert, clientKey := writeCert(t, dir, "client")
+	_, otherKey := writeCert(t, dir, "other")
+	garbage := filepath.Join(dir, "garbage.pem")
+	if err := ioutil.WriteFile(garbage, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		dialer Dialer
+		err    string
+	}{
+		{"missing CA bundle", Dialer{CAFile: filepath.Join(dir, "missing.pem")}, "reading CA bundle"},
+		{"unparsable CA bundle", Dialer{CAFile: garbage}, "no certificates found"},
+		{"CA bundle", Dialer{CAFile: serverCert}, ""},
+		{"client certificate", Dialer{CertFile: clientCert, KeyFile: clientKey}, ""},
+		{"mismatched key", Dialer{CertFile: clientCert, KeyFile: otherKey}, "loading client certificate"},
+		{"skip verify", Dialer{InsecureSkipVerify: true}, ""},
+	} {
+		config, err := tc.dialer.tlsConfig("irc.example.com:6697")
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s: got error %v, want one containing %q", tc.name, err, tc.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if config.ServerName != "irc.example.com" {
+			t.Errorf("%s: ServerName %q, want irc.example.com", tc.name, config.ServerName)
+		}
+		if got, want := config.RootCAs != nil, tc.dialer.CAFile != ""; got != want {
+			t.Errorf("%s: RootCAs set %t, want %t", tc.name, got, want)
+		}
+		if got, want := len(config.Certificates) == 1, tc.dialer.CertFile != ""; got != want {
+			t.Errorf("%s: client certificate set %t, want %t", tc.name, got, want)
+		}
+		if config.InsecureSkipVerify != tc.dialer.InsecureSkipVerify {
+			t.Errorf("%s: InsecureSkipVerify %t, want %t", tc.name, config.InsecureSkipVerify, tc.dialer.InsecureSkipVerify)
+		}
+	}
+}
+
+func TestDialTLS(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	serverCert, serverKey := writeCert(t, dir, "server")
+	clientCert, clientKey := writeCert(t, dir, "client")
+
+	cert, err := tls.LoadX509KeyPair(serverCert, serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAnyClientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	peers := make(chan []*x509.Certificate, 2)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			tlsConn := conn.(*tls.Conn)
+			tlsConn.Handshake()
+			peers <- tlsConn.ConnectionState().PeerCertificates
+			conn.Close()
+		}
+	}()
+
+	d := &Dialer{TLS: true, CAFile: serverCert, CertFile: clientCert, KeyFile: clientKey, Timeout: 5 * time.Second}
+	conn, err := d.DialContext(context.Background(), ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if got := <-peers; len(got) != 1 || got[0].Subject.CommonName != "client" {
+		t.Errorf("server saw client certificates %v, want the one from CertFile", got)
+	}
+
+	// Without the CA bundle the self-signed certificate is rejected.
+	d = &Dialer{TLS: true, Timeout: 5 * time.Second}
+	if conn, err := d.DialContext(context.Background(), ln.Addr().String()); err == nil {
+		conn.Close()
+		t.Error("dialled a server with an untrusted certificate")
+	}
+}
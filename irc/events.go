@@ -0,0 +1,133 @@
+package irc
+
+import (
+	"fmt"
+	"strings"
+)
+
+// HandlerFunc handles a message received from the server. Handlers run on
+// the goroutine reading from the connection, in the order they were
+// registered, so they must not block.
+type HandlerFunc func(c *Client, m *Message)
+
+// AllMessages can be passed to Handle to receive every message.
+const AllMessages = "*"
+
+// Handle registers h to be called for every message with the given command,
+// e.g. "JOIN" or a three digit numeric such as "433".
+func (c *Client) Handle(command string, h HandlerFunc) {
+	c.handlersMu.Lock()
+	defer c.handlersMu.Unlock()
+	if c.handlers == nil {
+		c.handlers = make(map[string][]HandlerFunc)
+	}
+	command = strings.ToUpper(command)
+	c.handlers[command] = append(c.handlers[command], h)
+}
+
+// OnNumeric registers h for the numeric reply code.
+func (c *Client) OnNumeric(code int, h HandlerFunc) {
+	c.Handle(fmt.Sprintf("%03d", code), h)
+}
+
+func (c *Client) dispatch(m *Message) {
+	c.handlersMu.RLock()
+	var handlers []HandlerFunc
+	handlers = append(handlers, c.handlers[m.Command]...)
+	handlers = append(handlers, c.handlers[AllMessages]...)
+	c.handlersMu.RUnlock()
+
+	for _, h := range handlers {
+		h(c, m)
+	}
+}
+
+type Join struct {
+	Source  Source
+	Channel string
+	// Account is the user's services account, if known from extended-join
+	// or the account tag.
+	Account string
+}
+
+type Part struct {
+	Source  Source
+	Channel string
+	Reason  string
+}
+
+type Kick struct {
+	Source  Source
+	Channel string
+	Nick    string
+	Reason  string
+}
+
+type Quit struct {
+	Source Source
+	Reason string
+}
+
+type NickChange struct {
+	Source  Source
+	NewNick string
+}
+
+type Mode struct {
+	Source Source
+	Target string
+	Modes  string
+	Args   []string
+}
+
+type Topic struct {
+	Source  Source
+	Channel string
+	Topic   string
+}
+
+func (c *Client) OnJoin(h func(*Client, *Join)) {
+	c.Handle("JOIN", func(c *Client, m *Message) {
+		h(c, &Join{Source: m.Source, Channel: m.Param(0), Account: joinAccount(m)})
+	})
+}
+
+func (c *Client) OnPart(h func(*Client, *Part)) {
+	c.Handle("PART", func(c *Client, m *Message) {
+		h(c, &Part{Source: m.Source, Channel: m.Param(0), Reason: m.Param(1)})
+	})
+}
+
+func (c *Client) OnKick(h func(*Client, *Kick)) {
+	c.Handle("KICK", func(c *Client, m *Message) {
+		h(c, &Kick{Source: m.Source, Channel: m.Param(0), Nick: m.Param(1), Reason: m.Param(2)})
+	})
+}
+
+func (c *Client) OnQuit(h func(*Client, *Quit)) {
+	c.Handle("QUIT", func(c *Client, m *Message) {
+		h(c, &Quit{Source: m.Source, Reason: m.Param(0)})
+	})
+}
+
+func (c *Client) OnNick(h func(*Client, *NickChange)) {
+	c.Handle("NICK", func(c *Client, m *Message) {
+		h(c, &NickChange{Source: m.Source, NewNick: m.Param(0)})
+	})
+}
+
+func (c *Client) OnMode(h func(*Client, *Mode)) {
+	c.Handle("MODE", func(c *Client, m *Message) {
+		e := &Mode{Source: m.Source, Target: m.Param(0), Modes: m.Param(1)}
+		if len(m.Params) > 2 {
+			e.Args = m.Params[2:]
+		}
+		h(c, e)
+	})
+}
+
+func (c *Client) OnTopic(h func(*Client, *Topic)) {
+	c.Handle("TOPIC", func(c *Client, m *Message) {
+		h(c, &Topic{Source: m.Source, Channel: m.Param(0), Topic: m.Param(1)})
+	})
+}
@@ -0,0 +1,127 @@
+// Package format handles the mIRC formatting codes used in IRC messages:
+// colors, bold, italics, underline and the like.
+package format
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Formatting control codes.
+const (
+	BoldCode          = "\x02"
+	ColorCode         = "\x03"
+	HexColorCode      = "\x04"
+	ResetCode         = "\x0f"
+	MonospaceCode     = "\x11"
+	ReverseCode       = "\x16"
+	ItalicCode        = "\x1d"
+	StrikethroughCode = "\x1e"
+	UnderlineCode     = "\x1f"
+)
+
+// Color is one of the 16 standard mIRC colors.
+type Color int
+
+const (
+	White Color = iota
+	Black
+	Blue
+	Green
+	Red
+	Brown
+	Magenta
+	Orange
+	Yellow
+	LightGreen
+	Cyan
+	LightCyan
+	LightBlue
+	Pink
+	Grey
+	LightGrey
+)
+
+// Bold returns s in bold.
+func Bold(s string) string { return BoldCode + s + BoldCode }
+
+// Italic returns s in italics.
+func Italic(s string) string { return ItalicCode + s + ItalicCode }
+
+// Underline returns s underlined.
+func Underline(s string) string { return UnderlineCode + s + UnderlineCode }
+
+// Colored returns s in the foreground color fg. Two digits are always used
+// for the color so that text starting with a digit is not misread.
+func Colored(s string, fg Color) string {
+	return fmt.Sprintf("%s%02d%s%s", ColorCode, fg, s, ColorCode)
+}
+
+// ColoredOn returns s in the foreground color fg on the background bg.
+func ColoredOn(s string, fg, bg Color) string {
+	return fmt.Sprintf("%s%02d,%02d%s%s", ColorCode, fg, bg, s, ColorCode)
+}
+
+// Strip removes all formatting codes from s, including color numbers.
+func Strip(s string) string {
+	if !strings.ContainsAny(s, "\x02\x03\x04\x0f\x11\x16\x1d\x1e\x1f") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		if n := CodeLen(s[i:]); n > 0 {
+			i += n
+			continue
+		}
+		b.WriteByte(s[i])
+		i++
+	}
+	return b.String()
+}
+
+// CodeLen returns the length of the formatting code at the start of s,
+// including any color numbers, or 0 if s does not start with one. Colors
+// are \x03 followed by up to two digits and an optional comma with up to two
+// more, or \x04 followed by a six digit hex color and optionally a comma and
+// six more.
+func CodeLen(s string) int {
+	if s == "" {
+		return 0
+	}
+	switch s[0] {
+	case '\x02', '\x0f', '\x11', '\x16', '\x1d', '\x1e', '\x1f':
+		return 1
+	case '\x03':
+		return skipColor(s, 1, isDigit, 2)
+	case '\x04':
+		return skipColor(s, 1, isHexDigit, 6)
+	}
+	return 0
+}
+
+// skipColor returns the end of the "fg[,bg]" color numbers starting at i,
+// each made of up to n valid digits. A comma is only part of the code if a
+// background color follows it.
+func skipColor(s string, i int, valid func(byte) bool, n int) int {
+	j := i
+	for j < len(s) && j-i < n && valid(s[j]) {
+		j++
+	}
+	if j == i {
+		return j
+	}
+	if j+1 < len(s) && s[j] == ',' && valid(s[j+1]) {
+		k := j + 1
+		for k < len(s) && k-(j+1) < n && valid(s[k]) {
+			k++
+		}
+		return k
+	}
+	return j
+}
+
+func isDigit(b byte) bool { return b >= '0' && b <= '9' }
+
+func isHexDigit(b byte) bool {
+	return isDigit(b) || (b >= 'a' && b <= 'f') || (b >= 'A' && b <= 'F')
+}
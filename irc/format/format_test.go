@@ -0,0 +1,34 @@
+package format
+
+import "testing"
+
+func TestStrip(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+	}{
+		{"plain text", "plain text"},
+		{"\x02bob\x02++", "bob++"},
+		{"\x1ditalic\x1d \x1funderline\x1f \x1estrike\x1e \x11mono\x11 \x16reverse\x16\x0f", "italic underline strike mono reverse"},
+		{"\x0304red\x03 \x034,12on blue\x03 \x03plain", "red on blue plain"},
+		{"\x0312345", "345"},
+		{"\x034,five", ",five"},
+		{"\x04ff0000hex\x04 \x04FF0000,00ff00both", "hex both"},
+		{"trailing\x03", "trailing"},
+	} {
+		if got := Strip(tc.in); got != tc.want {
+			t.Errorf("Strip(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestColored(t *testing.T) {
+	if got, want := Colored("1", Green), "\x03031\x03"; got != want {
+		t.Errorf("Colored = %q, want %q", got, want)
+	}
+	if got, want := ColoredOn("x", White, Black), "\x0300,01x\x03"; got != want {
+		t.Errorf("ColoredOn = %q, want %q", got, want)
+	}
+	if got := Strip(Bold(Colored("42", Red))); got != "42" {
+		t.Errorf("Strip(Bold(Colored)) = %q, want 42", got)
+	}
+}
@@ -0,0 +1,205 @@
+package irc
+
+import (
+	"context"
+	"sync"
+)
+
+// DefaultInboxSize is how many private messages may wait to be read from
+// PrivateMessages before the overflow policy applies, unless set with
+// WithInbox.
+const DefaultInboxSize = 100
+
+// OverflowPolicy decides what happens to a private message that arrives
+// while the inbox is full.
+type OverflowPolicy int
+
+const (
+	// DropOldest discards the message that has waited longest to make
+	// room. It is the default.
+	DropOldest OverflowPolicy = iota
+	// DropNewest discards the message that just arrived.
+	DropNewest
+	// Block stops reading from the server until there is room. PINGs
+	// go unanswered meanwhile, so a slow reader may get the client
+	// disconnected.
+	Block
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case DropOldest:
+		return "drop oldest"
+	case DropNewest:
+		return "drop newest"
+	case Block:
+		return "block"
+	}
+	return "unknown"
+}
+
+// WithInbox sets how many private messages may wait to be read from
+// PrivateMessages, and what to do with more. Messages are read from the
+// server and protocol messages such as PING answered regardless of how
+// quickly PrivateMessages is read, until the inbox is full.
+func WithInbox(size int, policy OverflowPolicy) Option {
+	return func(c *Client) {
+		if size < 1 {
+			size = 1
+		}
+		c.inboxSize = size
+		c.overflow = policy
+	}
+}
+
+// InboxStats describes the private messages waiting to be read from
+// PrivateMessages.
+type InboxStats struct {
+	Queued int
+	// Dropped counts the messages discarded since the client was
+	// created, by the overflow policy or because the client stopped
+	// while they waited for room.
+	Dropped int
+}
+
+// InboxStats returns the current state of the inbox.
+func (c *Client) InboxStats() InboxStats {
+	c.inbox.mu.Lock()
+	defer c.inbox.mu.Unlock()
+	return InboxStats{Queued: len(c.inbox.messages), Dropped: c.inbox.dropped}
+}
+
+// inbox holds private messages between the goroutine reading from the
+// server and the one delivering them to PrivateMessages.
+type inbox struct {
+	mu       sync.Mutex
+	messages []*PrivateMessage
+	size     int
+	policy   OverflowPolicy
+	dropped  int
+	closed   bool
+	// ready and space are signalled when a message is added and
+	// removed; closing is closed by close.
+	ready   chan struct{}
+	space   chan struct{}
+	closing chan struct{}
+}
+
+func newInbox(size int, policy OverflowPolicy) *inbox {
+	return &inbox{
+		size:    size,
+		policy:  policy,
+		ready:   make(chan struct{}, 1),
+		space:   make(chan struct{}, 1),
+		closing: make(chan struct{}),
+	}
+}
+
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// push adds p, applying the overflow policy if the inbox is full. It
+// reports whether a message was dropped. With the Block policy it waits for
+// room until stop or quit is closed or the inbox is closed, and then drops p.
+func (b *inbox) push(p *PrivateMessage, stop, quit <-chan struct{}) (dropped bool) {
+	for {
+		b.mu.Lock()
+		switch {
+		case b.closed:
+			b.dropped++
+			dropped = true
+		case len(b.messages) < b.size:
+			b.messages = append(b.messages, p)
+			signal(b.ready)
+		case b.policy == DropOldest:
+			b.messages = append(b.messages[1:], p)
+			b.dropped++
+			dropped = true
+		case b.policy == DropNewest:
+			b.dropped++
+			dropped = true
+		default:
+			b.mu.Unlock()
+			select {
+			case <-b.space:
+				continue
+			case <-stop:
+			case <-quit:
+			case <-b.closing:
+			}
+			b.mu.Lock()
+			b.dropped++
+			b.mu.Unlock()
+			return true
+		}
+		b.mu.Unlock()
+		return dropped
+	}
+}
+
+// pop removes the oldest message, waiting for one if the inbox is empty. It
+// returns false once the inbox is closed and empty.
+func (b *inbox) pop() (*PrivateMessage, bool) {
+	for {
+		b.mu.Lock()
+		if len(b.messages) > 0 {
+			p := b.messages[0]
+			b.messages[0] = nil
+			b.messages = b.messages[1:]
+			b.mu.Unlock()
+			signal(b.space)
+			return p, true
+		}
+		closed := b.closed
+		b.mu.Unlock()
+		if closed {
+			return nil, false
+		}
+		select {
+		case <-b.ready:
+		case <-b.closing:
+		}
+	}
+}
+
+// close stops the inbox from taking new messages. Those already queued can
+// still be popped.
+func (b *inbox) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.closed {
+		b.closed = true
+		close(b.closing)
+	}
+}
+
+// deliver passes messages from the inbox to PrivateMessages, which it
+// closes once the inbox has been closed and emptied, or when stop is closed
+// or the client quits.
+func (c *Client) deliver(stop <-chan struct{}) {
+	defer close(c.privMessages)
+	for {
+		p, ok := c.inbox.pop()
+		if !ok {
+			return
+		}
+		select {
+		case c.privMessages <- p:
+		case <-stop:
+			return
+		case <-c.quit:
+			return
+		}
+	}
+}
+
+// receive queues p to be delivered to PrivateMessages.
+func (c *Client) receive(ctx context.Context, p *PrivateMessage) {
+	if c.inbox.push(p, ctx.Done(), c.quit) {
+		c.logger.Printf("Dropped a message from %s (inbox of %d, policy %s)", p.Nick, c.inboxSize, c.overflow)
+	}
+}
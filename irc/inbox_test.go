@@ -0,0 +1,103 @@
+package irc
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestInboxOverflow(t *testing.T) {
+	for _, tc := range []struct {
+		policy OverflowPolicy
+		want   []string
+	}{
+		{DropOldest, []string{"two", "three"}},
+		{DropNewest, []string{"one", "two"}},
+	} {
+		b := newInbox(2, tc.policy)
+		dropped := 0
+		for _, text := range []string{"one", "two", "three"} {
+			if b.push(&PrivateMessage{Text: text}, nil, nil) {
+				dropped++
+			}
+		}
+		b.close()
+
+		var got []string
+		for {
+			p, ok := b.pop()
+			if !ok {
+				break
+			}
+			got = append(got, p.Text)
+		}
+		if !reflect.DeepEqual(got, tc.want) || dropped != 1 || b.dropped != 1 {
+			t.Errorf("%s: got %q with %d dropped, want %q with 1", tc.policy, got, dropped, tc.want)
+		}
+	}
+}
+
+func TestInboxBlock(t *testing.T) {
+	b := newInbox(1, Block)
+	b.push(&PrivateMessage{Text: "one"}, nil, nil)
+	pushed := make(chan bool)
+	go func() { pushed <- b.push(&PrivateMessage{Text: "two"}, nil, nil) }()
+
+	if p, _ := b.pop(); p.Text != "one" {
+		t.Errorf("popped %q, want one", p.Text)
+	}
+	if dropped := <-pushed; dropped {
+		t.Error("push dropped a message")
+	}
+	if p, _ := b.pop(); p.Text != "two" {
+		t.Errorf("popped %q, want two", p.Text)
+	}
+
+	// A blocked push gives up once stop is closed.
+	b.push(&PrivateMessage{Text: "three"}, nil, nil)
+	stop := make(chan struct{})
+	close(stop)
+	if !b.push(&PrivateMessage{Text: "four"}, stop, nil) || b.dropped != 1 {
+		t.Errorf("push gave up with %d dropped, want the message counted as dropped", b.dropped)
+	}
+}
+
+func TestQuitWhileBlocked(t *testing.T) {
+	server, conn := net.Pipe()
+	defer server.Close()
+	go io.Copy(ioutil.Discard, server)
+
+	c := New(conn, WithInbox(1, Block))
+	go func() {
+		for range c.Messages() {
+		}
+	}()
+	done := make(chan error)
+	go func() { done <- c.Run(context.Background()) }()
+
+	// Nobody reads PrivateMessages, so the reader blocks on the third
+	// message at the latest.
+	io.WriteString(server, ":a!a@a PRIVMSG shelbot :one\r\n"+
+		":a!a@a PRIVMSG shelbot :two\r\n"+
+		":a!a@a PRIVMSG shelbot :three\r\n")
+	for c.InboxStats().Queued < 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	c.Quit("bye")
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run returned %v after Quit", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return after Quit")
+	}
+	if stats := c.InboxStats(); stats.Dropped < 1 {
+		t.Errorf("%d messages dropped, want the blocked one counted", stats.Dropped)
+	}
+}
@@ -2,42 +2,208 @@ package irc
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/textproto"
 	"strings"
 	"sync"
 	"time"
 )
 
+var ErrPingTimeout = errors.New("irc: ping timeout")
+
 type Client struct {
-	conn         io.ReadWriter
 	quit         chan struct{}
 	once         sync.Once
+	stopped      chan struct{}
+	writerDone   chan struct{}
+	closeOnce    sync.Once
 	messages     chan *Message
 	privMessages chan *PrivateMessage
+	inbox        *inbox
 	logger       *log.Logger
-	pause        time.Duration
+	readTimeout  time.Duration
+	maxLines     int
+	version      string
+	queue        *sendQueue
+	bucket       *tokenBucket
+	writeMu      sync.Mutex
+	recorder     io.Writer
+	recordMu     sync.Mutex
+	handlersMu   sync.RWMutex
+	handlers     map[string][]HandlerFunc
+	stateMu      sync.RWMutex
+	channels     map[string]*channelState
+	queryMu      sync.Mutex
+	queries      []*query
+
+	stripFormatting bool
+	inboxSize       int
+	overflow        OverflowPolicy
+	altNicks        []string
+	reclaimInterval time.Duration
+	regainMethod    string
+	regainPassword  string
+	pingInterval    time.Duration
+	pingTimeout     time.Duration
+	sendTimeout     time.Duration
+
+	mu            sync.Mutex
+	conn          io.ReadWriter
+	registered    chan struct{}
+	isRegistered  bool
+	wantCaps      []string
+	availableCaps map[string]string
+	caps          map[string]bool
+	capsDone      bool
+	sasl          *saslConfig
+	serverPass    string
+	account       string
+	nick          string
+	primaryNick   string
+	nickAttempt   int
+	prefix        string
+	features      ServerFeatures
+	batches       map[string]string
+	lastRead      time.Time
+	pingToken     string
+	pingSent      time.Time
+	pingTimedOut  bool
+	lag           time.Duration
+	registeredAt  time.Time
+	regainTimer   *time.Timer
 }
 
+// Messages and PrivateMessages deliver what the client receives. Messages
+// is closed when Run, or the Run method of the Supervisor driving the client,
+// returns. PrivateMessages is closed once the messages still in the inbox
+// have been read, or straight away if the client quit or the context passed
+// to Run was cancelled.
 func (c *Client) Messages() <-chan *Message               { return c.messages }
 func (c *Client) PrivateMessages() <-chan *PrivateMessage { return c.privMessages }
 
+// closeChannels closes the channels the client delivers on once Run or
+// Supervisor.Run returns. If they returned because ctx was cancelled the
+// writer stops too; otherwise what is still queued can be flushed.
+func (c *Client) closeChannels(ctx context.Context) {
+	c.closeOnce.Do(func() {
+		if ctx.Err() != nil {
+			close(c.stopped)
+		}
+		close(c.messages)
+		c.inbox.close()
+	})
+}
+
+// Nick returns the nick the client is currently using.
+func (c *Client) Nick() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.nick
+}
+
+// Registered is closed once the server has accepted the client's registration
+// (RPL_WELCOME), which happens after capability negotiation has finished.
+func (c *Client) Registered() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.registered
+}
+
+// welcome records the nick the server registered us with. Many servers
+// also include our full hostmask at the end of the welcome text.
+func (c *Client) welcome(m *Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nick = m.Param(0)
+	words := strings.Fields(m.Param(1))
+	if len(words) == 0 {
+		return
+	}
+	if src := parseSource(words[len(words)-1]); src.Nick == c.nick && src.User != "" && src.Host != "" {
+		c.prefix = src.String()
+	}
+}
+
+// RegisteredAt returns when the client registered on the current
+// connection, or the zero time if it has not.
+func (c *Client) RegisteredAt() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.registeredAt
+}
+
+func (c *Client) markRegistered() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.capsDone = true
+	if !c.isRegistered {
+		c.isRegistered = true
+		c.registeredAt = time.Now()
+		close(c.registered)
+	}
+}
+
+// reset prepares the client for a new connection, discarding all state
+// tied to the previous one. Each connection gets a fresh flood control
+// allowance.
+func (c *Client) reset(conn io.ReadWriter) {
+	c.resetState()
+	c.failQueries(ErrDisconnected)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn = conn
+	c.queue.clear()
+	c.bucket = newTokenBucket(c.bucket.burst, c.bucket.interval)
+	c.registered = make(chan struct{})
+	c.isRegistered = false
+	c.registeredAt = time.Time{}
+	c.availableCaps = make(map[string]string)
+	c.caps = make(map[string]bool)
+	c.capsDone = false
+	c.account = ""
+	c.prefix = ""
+	c.features = defaultFeatures()
+	c.batches = nil
+}
+
 func New(conn io.ReadWriter, opts ...Option) *Client {
 	c := &Client{
-		conn:         conn,
-		quit:         make(chan struct{}),
-		messages:     make(chan *Message),
-		privMessages: make(chan *PrivateMessage),
-		logger:       log.New(ioutil.Discard, "IRC: ", log.LstdFlags),
-		pause:        1 * time.Second,
+		conn:          conn,
+		quit:          make(chan struct{}),
+		stopped:       make(chan struct{}),
+		writerDone:    make(chan struct{}),
+		messages:      make(chan *Message),
+		privMessages:  make(chan *PrivateMessage),
+		logger:        log.New(ioutil.Discard, "IRC: ", log.LstdFlags),
+		version:       "shelbot irc client",
+		queue:         newSendQueue(),
+		bucket:        newTokenBucket(5, time.Second),
+		registered:    make(chan struct{}),
+		channels:      make(map[string]*channelState),
+		features:      defaultFeatures(),
+		inboxSize:     DefaultInboxSize,
+		caps:          make(map[string]bool),
+		availableCaps: make(map[string]string),
 	}
+	c.trackState()
+	c.trackNick()
+	c.Handle("PONG", c.handlePong)
+	c.Handle("BATCH", c.handleBatch)
+	c.Handle(AllMessages, c.answerQueries)
 
 	for _, opt := range opts {
 		opt(c)
 	}
+	c.inbox = newInbox(c.inboxSize, c.overflow)
+
+	go c.writeLoop()
 
 	return c
 }
@@ -47,14 +213,34 @@ type Option func(*Client)
 func WithLogger(logger *log.Logger) Option {
 	return func(c *Client) { c.logger = logger }
 }
-func WithPause(pause time.Duration) Option {
-	return func(c *Client) { c.pause = pause }
+
+// WithReadTimeout makes Run fail with ErrPingTimeout if nothing is
+// received from the server for the given duration. It only has an effect on
+// connections that support read deadlines, such as a net.Conn.
+func WithReadTimeout(timeout time.Duration) Option {
+	return func(c *Client) { c.readTimeout = timeout }
 }
 
 func (c *Client) Connect(nick, realName string) error {
-	c.send("USER %s 8 * :%s", nick, realName)
-	c.send("NICK %s", nick)
-	return nil
+	if len(c.wantCaps) > 0 {
+		if err := c.startCapNegotiation(); err != nil {
+			return err
+		}
+	}
+	if c.serverPass != "" {
+		if err := c.send("PASS %s", c.serverPass); err != nil {
+			return err
+		}
+	}
+	c.mu.Lock()
+	c.nick = nick
+	c.primaryNick = nick
+	c.nickAttempt = 0
+	c.mu.Unlock()
+	if err := c.send("USER %s 8 * :%s", nick, realName); err != nil {
+		return err
+	}
+	return c.send("NICK %s", nick)
 }
 
 func (c *Client) Join(channel string, key string) error {
@@ -72,80 +258,204 @@ func (c *Client) Part(channel string, partMessage string) error {
 	return c.send("PART %s %s", channel, partMessage)
 }
 
-func (c *Client) Send(target string, text string) error {
-	response := fmt.Sprintf("PRIVMSG %s :%s", target, text)
-	for len(text) > 0 {
-		if len(response) > 400 {
-			lastSpace := strings.LastIndex(response[:400], " ")
-			text = response[lastSpace+1:]
-			response = response[:lastSpace]
-			if err := c.send(response); err != nil {
-				return err
-			}
-		} else {
-			return c.send(response)
-		}
-		response = fmt.Sprintf("PRIVMSG %s :%s", target, text)
+// Send queues text to be sent to target as a PRIVMSG. It does not block; if
+// ctx is done before a line's turn to be written comes, the line is dropped.
+func (c *Client) Send(ctx context.Context, target string, text string, opts ...SendOption) error {
+	return c.sendText(ctx, "PRIVMSG", target, text, "", "", opts...)
+}
+
+// sendText queues text for target, split over as many lines as needed with
+// each line wrapped in before and after.
+func (c *Client) sendText(ctx context.Context, command, target, text, before, after string, opts ...SendOption) error {
+	budget := c.textBudget(command, target) - len(before) - len(after)
+	tags := c.tagPrefix(opts)
+	var lines []string
+	for _, line := range splitText(text, budget, c.maxLines) {
+		lines = append(lines, fmt.Sprintf("%s%s %s :%s%s%s", tags, command, target, before, line, after))
 	}
-	return nil
+	if len(lines) == 0 {
+		return nil
+	}
+	var deadline time.Time
+	if c.sendTimeout > 0 {
+		deadline = time.Now().Add(c.sendTimeout)
+	}
+	return c.queue.push(ctx, deadline, target, lines...)
 }
 
+// Quit sends QUIT and disconnects, making Run return nil. The client can
+// not be used again afterwards.
 func (c *Client) Quit(quitMessage string) error {
 	if quitMessage != "" {
 		quitMessage = fmt.Sprintf(":%s", quitMessage)
 	}
-	if err := c.send("QUIT %s", quitMessage); err != nil {
-		return err
-	}
+	// QUIT bypasses the queue so that it is written before the writer
+	// goroutine stops.
+	err := c.writeLine(fmt.Sprintf("QUIT %s", quitMessage))
 	c.once.Do(func() { close(c.quit) })
-	return nil
+	return err
+}
+
+func (c *Client) quitting() bool {
+	select {
+	case <-c.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// Run reads and dispatches messages from the connection passed to New until
+// ctx is cancelled, Quit is called or the connection fails. It returns nil
+// after Quit and ctx.Err() if ctx was cancelled. The channels returned by
+// Messages and PrivateMessages are then closed as described for them.
+func (c *Client) Run(ctx context.Context) error {
+	go c.deliver(ctx.Done())
+	defer c.closeChannels(ctx)
+	return c.listen(ctx)
 }
 
-func (c *Client) Listen() error {
-	reader := bufio.NewReader(c.conn)
+// listen handles a single connection. The connection is closed when ctx is
+// done or the client quits so that a blocked read returns.
+func (c *Client) listen(ctx context.Context) error {
+	c.mu.Lock()
+	conn := c.conn
+	c.lastRead = time.Now()
+	c.pingToken = ""
+	c.pingTimedOut = false
+	c.lag = 0
+	c.mu.Unlock()
+	deadliner, _ := conn.(interface{ SetReadDeadline(time.Time) error })
+
+	done := make(chan struct{})
+	defer close(done)
+	defer c.stopRegain()
+	defer c.failQueries(ErrDisconnected)
+	go c.reclaimLoop(done)
+	go c.keepalive(conn, done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-c.quit:
+		case <-done:
+			return
+		}
+		if closer, ok := conn.(io.Closer); ok {
+			closer.Close()
+		}
+	}()
+
+	reader := bufio.NewReader(conn)
 	response := textproto.NewReader(reader)
 	c.logger.Println("Ready to Listen")
 	for {
-		select {
-		case <-c.quit:
-			c.logger.Println("Listen exiting")
-			return nil
-		default:
-			line, err := response.ReadLine()
-			if err != nil {
-				if strings.Contains(err.Error(), "use of closed network connection") {
-					return err
-				}
-				c.logger.Println("Error calling ReadLine()")
-				return err
+		if c.readTimeout > 0 && deadliner != nil {
+			deadliner.SetReadDeadline(time.Now().Add(c.readTimeout))
+		}
+		line, err := response.ReadLine()
+		if err != nil {
+			if c.quitting() {
+				c.logger.Println("Listen exiting")
+				return nil
 			}
-			c.logger.Println(line)
-			lineElements := strings.Fields(line)
-			if lineElements[0] == "PING" {
-				c.send("PONG %s", lineElements[1])
-				c.logger.Println("PONG " + lineElements[1])
-				continue
+			if ctx.Err() != nil {
+				c.logger.Println("Listen exiting:", ctx.Err())
+				return ctx.Err()
+			}
+			c.mu.Lock()
+			timedOut := c.pingTimedOut
+			c.mu.Unlock()
+			if timedOut {
+				return ErrPingTimeout
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				c.logger.Println("No data received in", c.readTimeout)
+				return ErrPingTimeout
 			}
+			c.logger.Println("Error calling ReadLine()")
+			return err
+		}
+		c.logger.Println(line)
+		c.record(recordIn, line)
+		c.touch()
 
-			m, err := newMessage(line)
+		m, err := ParseMessage(line)
+		if err != nil {
+			c.logger.Println("Error parsing raw message:", err)
+			continue
+		}
+		c.learnPrefix(m)
+		switch m.Command {
+		case "PING":
+			// PONG bypasses the queue so that flood control never
+			// delays it long enough for the server to give up on us.
+			if err := c.writeLine("PONG :" + m.Param(0)); err != nil {
+				c.logger.Println("Error sending PONG:", err)
+			}
+			c.logger.Println("PONG " + m.Param(0))
+		case "CAP":
+			c.handleCap(m)
+		case "001":
+			c.welcome(m)
+			c.markRegistered()
+			c.identifyFallback()
+			c.regain()
+			c.forward(m)
+		case "AUTHENTICATE":
+			c.handleAuthenticate(m)
+		case "900", "902", "903", "904", "905", "906", "907":
+			if err := c.handleSASLReply(m); err != nil {
+				c.logger.Println(err)
+				return err
+			}
+		case "PRIVMSG":
+			p, err := privMsgFromMessage(m, c.Features().ChanTypes)
 			if err != nil {
-				c.logger.Println("Error parsing raw message:", err)
+				c.logger.Println("Error parsing PRIVMSG:", err)
+				continue
+			}
+			p.Text = c.stripText(p.Text)
+			p.Playback = c.inPlayback(m)
+			if p.Account == "" {
+				p.Account = c.AccountOf(p.Nick)
 			}
-			switch m.Command {
-			case "PRIVMSG":
-				c.privMessages <- privMsgFromMessage(m)
-			default:
-				select {
-				case c.messages <- m:
-				default:
-				}
+			if p.CTCP != nil && c.replyCTCP(p) {
+				break
 			}
+			c.receive(ctx, p)
+		default:
+			c.forward(m)
 		}
+		c.dispatch(m)
+	}
+}
+
+func (c *Client) forward(m *Message) {
+	select {
+	case c.messages <- m:
+	default:
 	}
 }
 
+// send queues a protocol line ahead of any pending messages.
 func (c *Client) send(format string, args ...interface{}) error {
-	_, err := c.conn.Write([]byte(fmt.Sprintf(format+"\r\n", args...)))
-	time.Sleep(c.pause)
-	return err
+	c.queue.pushPriority(fmt.Sprintf(format, args...))
+	return nil
+}
+
+func (c *Client) writeLine(line string) error {
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	if conn == nil {
+		return errors.New("irc: not connected")
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if _, err := conn.Write([]byte(line + "\r\n")); err != nil {
+		return err
+	}
+	c.record(recordOut, line)
+	return nil
 }
@@ -0,0 +1,225 @@
+// Package irctest provides a scriptable, in-process IRC server for testing
+// code built on the irc package without a network connection.
+package irctest
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/davidjpeacock/shelbot/irc"
+)
+
+// ServerName is the name the fake server uses as the source of its replies.
+const ServerName = "irc.example.net"
+
+// Server is the server end of a connection to a single client. Lines sent by
+// the client are buffered so the client never blocks writing to it, and can
+// be inspected with Next and Expect.
+type Server struct {
+	// Caps are the capabilities advertised in reply to CAP LS. Requests for
+	// any of them are acknowledged.
+	Caps []string
+	// Timeout bounds how long Next and Expect wait for the client. It
+	// defaults to 2 seconds.
+	Timeout time.Duration
+
+	t     testing.TB
+	conn  net.Conn
+	lines chan string
+	nick  string
+}
+
+// NewServer returns a fake server and the client end of its connection, to
+// be passed to irc.New or returned from an irc.Supervisor's Dial.
+func NewServer(t testing.TB) (*Server, net.Conn) {
+	serverConn, clientConn := net.Pipe()
+	s := &Server{
+		Timeout: 2 * time.Second,
+		t:       t,
+		conn:    serverConn,
+		lines:   make(chan string, 1024),
+	}
+	go s.read()
+	return s, clientConn
+}
+
+func (s *Server) read() {
+	defer close(s.lines)
+	scanner := bufio.NewScanner(s.conn)
+	for scanner.Scan() {
+		s.lines <- strings.TrimRight(scanner.Text(), "\r")
+	}
+}
+
+// Close closes the connection, as if the server went away.
+func (s *Server) Close() error {
+	return s.conn.Close()
+}
+
+// Nick returns the nick the client registered with.
+func (s *Server) Nick() string {
+	return s.nick
+}
+
+// Send writes raw lines to the client. CRLF is added to each line.
+func (s *Server) Send(lines ...string) {
+	s.t.Helper()
+	for _, line := range lines {
+		s.conn.SetWriteDeadline(time.Now().Add(s.Timeout))
+		if _, err := s.conn.Write([]byte(line + "\r\n")); err != nil {
+			s.t.Fatalf("irctest: writing %q: %v", line, err)
+		}
+	}
+}
+
+// Sendf formats and writes a single line to the client.
+func (s *Server) Sendf(format string, args ...interface{}) {
+	s.t.Helper()
+	s.Send(fmt.Sprintf(format, args...))
+}
+
+// Numeric sends a numeric reply addressed to the client.
+func (s *Server) Numeric(code int, params ...string) {
+	s.t.Helper()
+	s.Send((&irc.Message{
+		Source:  irc.Source{Nick: ServerName},
+		Command: fmt.Sprintf("%03d", code),
+		Params:  append([]string{s.target()}, params...),
+	}).String())
+}
+
+// Privmsg sends a PRIVMSG from nick, given a made up user and host.
+func (s *Server) Privmsg(nick, target, text string) {
+	s.t.Helper()
+	s.Sendf(":%s PRIVMSG %s :%s", Mask(nick), target, text)
+}
+
+// Join sends a JOIN of channel by nick.
+func (s *Server) Join(nick, channel string) {
+	s.t.Helper()
+	s.Sendf(":%s JOIN %s", Mask(nick), channel)
+}
+
+// Mask returns the nick!user@host used for nick by the fake server.
+func Mask(nick string) string {
+	return nick + "!~" + nick + "@example.com"
+}
+
+func (s *Server) target() string {
+	if s.nick == "" {
+		return "*"
+	}
+	return s.nick
+}
+
+// Next returns the next message sent by the client, failing the test if
+// none arrives in time.
+func (s *Server) Next() *irc.Message {
+	s.t.Helper()
+	select {
+	case line, ok := <-s.lines:
+		if !ok {
+			s.t.Fatal("irctest: connection closed")
+		}
+		m, err := irc.ParseMessage(line)
+		if err != nil {
+			s.t.Fatalf("irctest: client sent invalid line: %v", err)
+		}
+		return m
+	case <-time.After(s.Timeout):
+		s.t.Fatal("irctest: timed out waiting for the client")
+	}
+	return nil
+}
+
+// Expect skips messages from the client until one has the given command and
+// starts with the given parameters, and returns it.
+func (s *Server) Expect(command string, params ...string) *irc.Message {
+	s.t.Helper()
+	deadline := time.Now().Add(s.Timeout)
+	for time.Now().Before(deadline) {
+		select {
+		case line, ok := <-s.lines:
+			if !ok {
+				s.t.Fatalf("irctest: connection closed waiting for %s %v", command, params)
+			}
+			m, err := irc.ParseMessage(line)
+			if err != nil || m.Command != command || len(m.Params) < len(params) {
+				continue
+			}
+			matched := true
+			for i, p := range params {
+				if m.Params[i] != p {
+					matched = false
+					break
+				}
+			}
+			if matched {
+				return m
+			}
+		case <-time.After(time.Until(deadline)):
+		}
+	}
+	s.t.Fatalf("irctest: timed out waiting for %s %v", command, params)
+	return nil
+}
+
+// ExpectNone fails the test if the client sends anything within d.
+func (s *Server) ExpectNone(d time.Duration) {
+	s.t.Helper()
+	select {
+	case line := <-s.lines:
+		s.t.Fatalf("irctest: unexpected line from client: %q", line)
+	case <-time.After(d):
+	}
+}
+
+// Register plays the server side of registration: capability negotiation
+// if the client starts it, including SASL which always succeeds, then NICK
+// and USER, followed by the welcome numerics and an empty MOTD.
+func (s *Server) Register() {
+	s.t.Helper()
+	negotiating := false
+	for s.nick == "" || negotiating {
+		m := s.Next()
+		switch m.Command {
+		case "CAP":
+			switch strings.ToUpper(m.Param(0)) {
+			case "LS":
+				negotiating = true
+				s.Sendf(":%s CAP * LS :%s", ServerName, strings.Join(s.Caps, " "))
+			case "REQ":
+				s.Sendf(":%s CAP * ACK :%s", ServerName, m.Param(1))
+			case "END":
+				negotiating = false
+			}
+		case "AUTHENTICATE":
+			if m.Param(0) == "PLAIN" || m.Param(0) == "EXTERNAL" {
+				s.Send("AUTHENTICATE +")
+				continue
+			}
+			s.Numeric(900, Mask(s.target()), s.target(), "You are now logged in")
+			s.Numeric(903, "SASL authentication successful")
+		case "NICK":
+			s.nick = m.Param(0)
+		}
+	}
+
+	s.Numeric(1, "Welcome to the Example IRC Network "+Mask(s.nick))
+	s.Numeric(2, "Your host is "+ServerName)
+	s.Numeric(3, "This server was created today")
+	s.Numeric(4, ServerName, "irctest", "iow", "bklmnopstv")
+	s.Numeric(5, "CASEMAPPING=rfc1459", "CHANTYPES=#", "PREFIX=(ov)@+", "NICKLEN=30", "are supported by this server")
+	s.Numeric(422, "MOTD File is missing")
+}
+
+// Ping sends a PING and waits for the client to answer it.
+func (s *Server) Ping(token string) {
+	s.t.Helper()
+	s.Sendf("PING :%s", token)
+	s.Expect("PONG", token)
+}
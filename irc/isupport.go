@@ -0,0 +1,146 @@
+package irc
+
+import (
+	"strconv"
+	"strings"
+)
+
+const (
+	CaseMappingASCII         = "ascii"
+	CaseMappingRFC1459       = "rfc1459"
+	CaseMappingStrictRFC1459 = "strict-rfc1459"
+)
+
+// ServerFeatures holds what the server announced about itself in
+// RPL_ISUPPORT (005).
+type ServerFeatures struct {
+	// CaseMapping is how the server compares nicks and channel names.
+	CaseMapping string
+	// ChanTypes are the characters channel names may start with.
+	ChanTypes string
+	// PrefixModes and PrefixSymbols are the channel membership modes and
+	// their nick prefixes, from highest to lowest rank, e.g. "ov" and "@+".
+	PrefixModes   string
+	PrefixSymbols string
+	// ChanModes are the channel modes grouped as list modes (A), modes that
+	// always take a parameter (B), modes that take one only when set (C) and
+	// flags (D).
+	ChanModes [4]string
+	NickLen   int
+	TopicLen  int
+	// LineLen is the maximum length of a line including CRLF.
+	LineLen int
+}
+
+func defaultFeatures() ServerFeatures {
+	return ServerFeatures{
+		CaseMapping:   CaseMappingRFC1459,
+		ChanTypes:     "#&",
+		PrefixModes:   "ov",
+		PrefixSymbols: "@+",
+		ChanModes:     [4]string{"beI", "k", "l", "imnpst"},
+		NickLen:       9,
+		LineLen:       maxLineLength,
+	}
+}
+
+// Features returns the features announced by the server, or the RFC 1459
+// defaults for anything it did not announce.
+func (c *Client) Features() ServerFeatures {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.features
+}
+
+// handleISupport parses RPL_ISUPPORT. Params are
+// <nick> <token>... :are supported by this server.
+func (c *Client) handleISupport(_ *Client, m *Message) {
+	if len(m.Params) < 3 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, token := range m.Params[1 : len(m.Params)-1] {
+		kv := strings.SplitN(token, "=", 2)
+		value := ""
+		if len(kv) == 2 {
+			value = kv[1]
+		}
+		switch kv[0] {
+		case "CASEMAPPING":
+			c.features.CaseMapping = strings.ToLower(value)
+		case "CHANTYPES":
+			c.features.ChanTypes = value
+		case "NICKLEN":
+			c.features.NickLen = atoiOr(value, c.features.NickLen)
+		case "TOPICLEN":
+			c.features.TopicLen = atoiOr(value, c.features.TopicLen)
+		case "LINELEN":
+			c.features.LineLen = atoiOr(value, c.features.LineLen)
+		case "PREFIX":
+			if i := strings.IndexByte(value, ')'); strings.HasPrefix(value, "(") && i > 0 {
+				modes, symbols := value[1:i], value[i+1:]
+				if len(modes) == len(symbols) {
+					c.features.PrefixModes, c.features.PrefixSymbols = modes, symbols
+				}
+			}
+		case "CHANMODES":
+			groups := strings.Split(value, ",")
+			for i := 0; i < len(groups) && i < 4; i++ {
+				c.features.ChanModes[i] = groups[i]
+			}
+		}
+	}
+}
+
+func atoiOr(s string, def int) int {
+	if n, err := strconv.Atoi(s); err == nil && n > 0 {
+		return n
+	}
+	return def
+}
+
+// FoldCase lowercases s according to the named case mapping. Under rfc1459
+// the characters []\^ are the uppercase forms of {}|~, strict-rfc1459 leaves
+// out ^ and ~. Unknown mappings fold Unicode letters.
+func FoldCase(mapping, s string) string {
+	var upper string
+	switch mapping {
+	case CaseMappingASCII:
+		upper = ""
+	case CaseMappingRFC1459, "":
+		upper = "[]\\^"
+	case CaseMappingStrictRFC1459:
+		upper = "[]\\"
+	default:
+		return strings.ToLower(s)
+	}
+
+	b := []byte(s)
+	for i, ch := range b {
+		switch {
+		case ch >= 'A' && ch <= 'Z':
+			b[i] = ch + 'a' - 'A'
+		case strings.IndexByte(upper, ch) >= 0:
+			// [ ] \ ^ are 32 below { } | ~ in ASCII.
+			b[i] = ch + 32
+		}
+	}
+	return string(b)
+}
+
+// FoldCase lowercases s using the server's case mapping.
+func (c *Client) FoldCase(s string) string {
+	return FoldCase(c.Features().CaseMapping, s)
+}
+
+// EqualFold reports whether two nicks or channel names are the same under
+// the server's case mapping.
+func (c *Client) EqualFold(a, b string) bool {
+	return c.FoldCase(a) == c.FoldCase(b)
+}
+
+// IsChannel reports whether target is a channel name rather than a nick.
+func (c *Client) IsChannel(target string) bool {
+	return target != "" && strings.IndexByte(c.Features().ChanTypes, target[0]) >= 0
+}
@@ -0,0 +1,98 @@
+package irc
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// WithKeepalive makes the client PING the server after interval without any
+// traffic. If no PONG arrives within timeout the connection is considered
+// dead and Run returns ErrPingTimeout.
+func WithKeepalive(interval, timeout time.Duration) Option {
+	return func(c *Client) {
+		c.pingInterval = interval
+		c.pingTimeout = timeout
+	}
+}
+
+// Lag returns the round trip time measured by the last keepalive PING, or
+// zero if none has been answered yet on this connection.
+func (c *Client) Lag() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lag
+}
+
+func (c *Client) touch() {
+	c.mu.Lock()
+	c.lastRead = time.Now()
+	c.mu.Unlock()
+}
+
+// handlePong measures lag from the reply to our keepalive PING. Params are
+// <server> :<token>.
+func (c *Client) handlePong(_ *Client, m *Message) {
+	token := m.Param(len(m.Params) - 1)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pingToken != "" && token == c.pingToken {
+		c.lag = time.Since(c.pingSent)
+		c.pingToken = ""
+	}
+}
+
+// keepalive sends PINGs while the connection is idle and closes it if the
+// server stops answering, until done is closed.
+func (c *Client) keepalive(conn io.ReadWriter, done <-chan struct{}) {
+	if c.pingInterval <= 0 {
+		return
+	}
+	timeout := c.pingTimeout
+	if timeout <= 0 {
+		timeout = c.pingInterval
+	}
+
+	check := c.pingInterval / 4
+	if check > time.Second {
+		check = time.Second
+	}
+	ticker := time.NewTicker(check)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			c.mu.Lock()
+			idle := now.Sub(c.lastRead)
+			waiting := c.pingToken != ""
+			overdue := waiting && now.Sub(c.pingSent) > timeout
+			if !waiting && idle >= c.pingInterval {
+				c.pingToken = fmt.Sprintf("shelbot-%d", now.UnixNano())
+				c.pingSent = now
+			}
+			token := c.pingToken
+			c.mu.Unlock()
+
+			switch {
+			case overdue:
+				c.logger.Printf("No PONG received in %s, closing connection", timeout)
+				c.mu.Lock()
+				c.pingTimedOut = true
+				c.mu.Unlock()
+				if closer, ok := conn.(io.Closer); ok {
+					closer.Close()
+				}
+				return
+			case !waiting && token != "":
+				// Like PONG, PING bypasses the queue so that flood
+				// control is not counted as lag.
+				if err := c.writeLine("PING :" + token); err != nil {
+					c.logger.Println("Error sending PING:", err)
+				}
+			}
+		case <-done:
+			return
+		}
+	}
+}
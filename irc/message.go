@@ -1,40 +1,234 @@
 package irc
 
 import (
-	"fmt"
+	"errors"
+	"sort"
 	"strconv"
 	"strings"
 )
 
+var (
+	ErrEmptyMessage   = errors.New("irc: empty message")
+	ErrMissingCommand = errors.New("irc: message has no command")
+	ErrMissingParams  = errors.New("irc: not enough parameters")
+)
+
+// ParseError is returned when a raw line cannot be parsed into a Message.
+type ParseError struct {
+	Raw string
+	Err error
+}
+
+func (e *ParseError) Error() string { return e.Err.Error() + ": " + strconv.Quote(e.Raw) }
+func (e *ParseError) Unwrap() error { return e.Err }
+
+// Source is the origin of a message, either a server name (in Nick) or a
+// nick!user@host mask.
+type Source struct {
+	Nick string
+	User string
+	Host string
+}
+
+func parseSource(s string) Source {
+	var src Source
+	if i := strings.IndexByte(s, '@'); i >= 0 {
+		src.Host = s[i+1:]
+		s = s[:i]
+	}
+	if i := strings.IndexByte(s, '!'); i >= 0 {
+		src.User = s[i+1:]
+		s = s[:i]
+	}
+	src.Nick = s
+	return src
+}
+
+func (s Source) String() string {
+	out := s.Nick
+	if s.User != "" {
+		out += "!" + s.User
+	}
+	if s.Host != "" {
+		out += "@" + s.Host
+	}
+	return out
+}
+
+// Message is a single line of the IRC protocol as described by RFC 1459 and
+// the IRCv3 message-tags specification. The trailing parameter, if any, is
+// the last element of Params and is kept verbatim.
 type Message struct {
-	Origin     string
-	Command    string
-	ReplyCode  int
-	Parameters string
+	Tags      map[string]string
+	Source    Source
+	Command   string
+	ReplyCode int
+	Params    []string
 }
 
-func newMessage(raw string) (*Message, error) {
-	m := &Message{}
+// Param returns the i'th parameter or an empty string if there is none.
+func (m *Message) Param(i int) string {
+	if i < 0 || i >= len(m.Params) {
+		return ""
+	}
+	return m.Params[i]
+}
 
-	parts := strings.Fields(raw)
+// ParseMessage parses a raw line, with or without its trailing CRLF.
+func ParseMessage(raw string) (*Message, error) {
+	line := strings.TrimRight(raw, "\r\n")
+	if strings.TrimLeft(line, " ") == "" {
+		return nil, &ParseError{Raw: raw, Err: ErrEmptyMessage}
+	}
+
+	m := &Message{}
 
-	if len(parts) < 2 {
-		return nil, fmt.Errorf("Received message was too short")
+	if line[0] == '@' {
+		var tags string
+		tags, line = nextToken(line[1:])
+		m.Tags = parseTags(tags)
 	}
 
-	if parts[0][0] == ':' {
-		//first element starts with a : so is a source
-		m.Origin = strings.TrimPrefix(parts[0], ":")
-		parts = parts[1:]
+	line = strings.TrimLeft(line, " ")
+	if strings.HasPrefix(line, ":") {
+		var source string
+		source, line = nextToken(line[1:])
+		m.Source = parseSource(source)
 	}
 
-	if n, err := strconv.Atoi(parts[0]); err == nil {
-		m.ReplyCode = n
-	} else {
-		m.Command = parts[0]
+	line = strings.TrimLeft(line, " ")
+	m.Command, line = nextToken(line)
+	if m.Command == "" {
+		return nil, &ParseError{Raw: raw, Err: ErrMissingCommand}
+	}
+	m.Command = strings.ToUpper(m.Command)
+	if len(m.Command) == 3 {
+		if n, err := strconv.Atoi(m.Command); err == nil {
+			m.ReplyCode = n
+		}
 	}
 
-	m.Parameters = strings.Join(parts[1:], " ")
+	for {
+		line = strings.TrimLeft(line, " ")
+		if line == "" {
+			break
+		}
+		if line[0] == ':' {
+			m.Params = append(m.Params, line[1:])
+			break
+		}
+		var param string
+		param, line = nextToken(line)
+		m.Params = append(m.Params, param)
+	}
 
 	return m, nil
 }
+
+func nextToken(s string) (token, rest string) {
+	if i := strings.IndexByte(s, ' '); i >= 0 {
+		return s[:i], s[i+1:]
+	}
+	return s, ""
+}
+
+func parseTags(s string) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(s, ";") {
+		if tag == "" {
+			continue
+		}
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) == 2 {
+			tags[kv[0]] = unescapeTagValue(kv[1])
+		} else {
+			tags[kv[0]] = ""
+		}
+	}
+	return tags
+}
+
+var tagEscaper = strings.NewReplacer(";", `\:`, " ", `\s`, `\`, `\\`, "\r", `\r`, "\n", `\n`)
+
+func unescapeTagValue(v string) string {
+	if strings.IndexByte(v, '\\') < 0 {
+		return v
+	}
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		if v[i] != '\\' {
+			b.WriteByte(v[i])
+			continue
+		}
+		i++
+		if i == len(v) {
+			// A lone trailing backslash is dropped.
+			break
+		}
+		switch v[i] {
+		case ':':
+			b.WriteByte(';')
+		case 's':
+			b.WriteByte(' ')
+		case 'r':
+			b.WriteByte('\r')
+		case 'n':
+			b.WriteByte('\n')
+		default:
+			b.WriteByte(v[i])
+		}
+	}
+	return b.String()
+}
+
+// formatTags returns tags as the "@key=value;... " prefix of a line, sorted
+// by key, or "" if there are none.
+func formatTags(tags map[string]string) string {
+	if len(tags) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteByte('@')
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte(';')
+		}
+		b.WriteString(k)
+		if v := tags[k]; v != "" {
+			b.WriteByte('=')
+			b.WriteString(tagEscaper.Replace(v))
+		}
+	}
+	b.WriteByte(' ')
+	return b.String()
+}
+
+// String encodes the message back into its wire form, without CRLF.
+func (m *Message) String() string {
+	var b strings.Builder
+	b.WriteString(formatTags(m.Tags))
+
+	if m.Source.Nick != "" {
+		b.WriteByte(':')
+		b.WriteString(m.Source.String())
+		b.WriteByte(' ')
+	}
+
+	b.WriteString(m.Command)
+
+	for i, p := range m.Params {
+		b.WriteByte(' ')
+		if i == len(m.Params)-1 && (p == "" || p[0] == ':' || strings.IndexByte(p, ' ') >= 0) {
+			b.WriteByte(':')
+		}
+		b.WriteString(p)
+	}
+
+	return b.String()
+}
@@ -0,0 +1,147 @@
+package irc
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseMessage(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want *Message
+	}{
+		{
+			raw: "PING :irc.example.net",
+			want: &Message{
+				Command: "PING",
+				Params:  []string{"irc.example.net"},
+			},
+		},
+		{
+			raw: ":bob!~bob@example.com PRIVMSG #shelly :hello  there: friend\r\n",
+			want: &Message{
+				Source:  Source{Nick: "bob", User: "~bob", Host: "example.com"},
+				Command: "PRIVMSG",
+				Params:  []string{"#shelly", "hello  there: friend"},
+			},
+		},
+		{
+			raw: "@time=2017-06-01T12:00:00.000Z;account=bob;+draft/reply=a\\sb\\:c :bob PRIVMSG shelbot ::)",
+			want: &Message{
+				Tags: map[string]string{
+					"time":         "2017-06-01T12:00:00.000Z",
+					"account":      "bob",
+					"+draft/reply": "a b;c",
+				},
+				Source:  Source{Nick: "bob"},
+				Command: "PRIVMSG",
+				Params:  []string{"shelbot", ":)"},
+			},
+		},
+		{
+			raw: ":irc.example.net 001 shelbot :Welcome to the network",
+			want: &Message{
+				Source:    Source{Nick: "irc.example.net"},
+				Command:   "001",
+				ReplyCode: 1,
+				Params:    []string{"shelbot", "Welcome to the network"},
+			},
+		},
+		{
+			raw: ":irc.example.net CAP * LS :",
+			want: &Message{
+				Source:  Source{Nick: "irc.example.net"},
+				Command: "CAP",
+				Params:  []string{"*", "LS", ""},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseMessage(tt.raw)
+		if err != nil {
+			t.Fatalf("ParseMessage(%q) returned error: %v", tt.raw, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Fatalf("ParseMessage(%q)\ngot  %#v\nwant %#v", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestParseMessageErrors(t *testing.T) {
+	tests := []struct {
+		raw string
+		err error
+	}{
+		{"", ErrEmptyMessage},
+		{"   \r\n", ErrEmptyMessage},
+		{":irc.example.net", ErrMissingCommand},
+		{"@a=b ", ErrMissingCommand},
+	}
+
+	for _, tt := range tests {
+		_, err := ParseMessage(tt.raw)
+		if !errors.Is(err, tt.err) {
+			t.Fatalf("ParseMessage(%q) error = %v, want %v", tt.raw, err, tt.err)
+		}
+	}
+}
+
+func TestMessageString(t *testing.T) {
+	raw := "@+draft/reply=a\\sb;time=now :bob!~bob@example.com PRIVMSG #shelly :hello there"
+	m, err := ParseMessage(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := m.String(); got != raw {
+		t.Fatalf("String() = %q, want %q", got, raw)
+	}
+}
+
+func TestPrivMsgFromMessage(t *testing.T) {
+	m, _ := ParseMessage(":bob!~bob@example.com PRIVMSG shelbot")
+	if _, err := privMsgFromMessage(m, "#&"); err != ErrMissingParams {
+		t.Fatalf("expected ErrMissingParams, got %v", err)
+	}
+
+	m, _ = ParseMessage(":bob!~bob@example.com PRIVMSG shelbot :help me")
+	p, err := privMsgFromMessage(m, "#&")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.User != "~bob@example.com" || p.ReplyChannel != "bob" || p.Text != "help me" {
+		t.Fatalf("unexpected private message: %#v", p)
+	}
+}
+
+func TestPrivMsgCTCP(t *testing.T) {
+	m, _ := ParseMessage(":bob!~bob@example.com PRIVMSG #shelly :\x01ACTION thanks shelbot++\x01")
+	p, err := privMsgFromMessage(m, "#")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.CTCP == nil || p.CTCP.Command != "ACTION" || p.Text != "thanks shelbot++" {
+		t.Fatalf("unexpected CTCP message: %#v", p)
+	}
+
+	if got := encodeCTCP("VERSION", "shelbot 2.5.3"); got != "\x01VERSION shelbot 2.5.3\x01" {
+		t.Fatalf("encodeCTCP = %q", got)
+	}
+}
+
+func TestMessageTime(t *testing.T) {
+	m, _ := ParseMessage("@time=2017-03-01T12:00:00.123Z :bob!~bob@example.com PRIVMSG #shelly :hi")
+	got, ok := m.Time()
+	if want := time.Date(2017, 3, 1, 12, 0, 0, 123e6, time.UTC); !ok || !got.Equal(want) {
+		t.Errorf("Time() = %v, %v, want %v", got, ok, want)
+	}
+
+	for _, raw := range []string{":bob PRIVMSG #shelly :hi", "@time=yesterday :bob PRIVMSG #shelly :hi"} {
+		m, _ := ParseMessage(raw)
+		if _, ok := m.Time(); ok {
+			t.Errorf("Time() succeeded for %q", raw)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package irc
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NickServ commands used to take back the primary nick from another
+// connection.
+const (
+	RegainGhost  = "GHOST"
+	RegainRegain = "REGAIN"
+)
+
+// ghostDelay is how long to wait after asking NickServ to ghost the primary
+// nick before trying to take it.
+var ghostDelay = 2 * time.Second
+
+// WithAltNicks sets the nicks to try, in order, when the one passed to
+// Connect is taken. Once they are exhausted underscores are appended to the
+// primary nick.
+func WithAltNicks(nicks ...string) Option {
+	return func(c *Client) { c.altNicks = nicks }
+}
+
+// WithNickReclaim sets how often the client tries to switch back to its
+// primary nick while using a fallback. It defaults to one minute.
+func WithNickReclaim(interval time.Duration) Option {
+	return func(c *Client) { c.reclaimInterval = interval }
+}
+
+// WithNickServRegain makes the client ask NickServ to free its primary nick
+// when registering under a fallback, using RegainGhost or RegainRegain.
+func WithNickServRegain(method, password string) Option {
+	return func(c *Client) {
+		c.regainMethod = strings.ToUpper(method)
+		c.regainPassword = password
+	}
+}
+
+// PrimaryNick returns the nick passed to Connect, which the client tries to
+// keep using.
+func (c *Client) PrimaryNick() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.primaryNick
+}
+
+func (c *Client) trackNick() {
+	c.Handle("NICK", c.nickChanged)
+	c.Handle("QUIT", c.nickFreed)
+	for _, code := range []string{"432", "433", "436", "437"} {
+		c.Handle(code, c.nickUnavailable)
+	}
+}
+
+// nickChanged follows changes to our own nick and notices when someone else
+// gives up the primary nick.
+func (c *Client) nickChanged(_ *Client, m *Message) {
+	if c.isMe(m.Source.Nick) {
+		c.mu.Lock()
+		c.nick = m.Param(0)
+		if c.prefix != "" {
+			c.prefix = c.nick + c.prefix[strings.IndexByte(c.prefix, '!'):]
+		}
+		c.mu.Unlock()
+		c.logger.Println("Nick changed to", m.Param(0))
+		return
+	}
+	c.nickFreed(c, m)
+}
+
+func (c *Client) nickFreed(_ *Client, m *Message) {
+	if c.EqualFold(m.Source.Nick, c.PrimaryNick()) && !c.isMe(m.Source.Nick) {
+		c.send("NICK %s", c.PrimaryNick())
+	}
+}
+
+// nickUnavailable picks the next fallback nick while registering. Once
+// registered the error can only be a failed reclaim, which is retried later.
+func (c *Client) nickUnavailable(_ *Client, m *Message) {
+	c.mu.Lock()
+	if c.isRegistered {
+		c.mu.Unlock()
+		return
+	}
+	c.nickAttempt++
+	next := c.primaryNick
+	if c.nickAttempt <= len(c.altNicks) {
+		next = c.altNicks[c.nickAttempt-1]
+	} else {
+		n := c.nickAttempt - len(c.altNicks)
+		suffix := strings.Repeat("_", n)
+		if nickLen := c.features.NickLen; len(next)+len(suffix) > nickLen {
+			// Keep within NICKLEN by numbering instead, truncating if needed.
+			suffix = strconv.Itoa(n)
+			if cut := nickLen - len(suffix); cut > 0 && cut < len(next) {
+				next = next[:cut]
+			}
+		}
+		next += suffix
+	}
+	c.nick = next
+	c.mu.Unlock()
+
+	c.logger.Printf("Nick %s unavailable (%s), trying %s", m.Param(1), m.Command, next)
+	c.send("NICK %s", next)
+}
+
+// regain asks NickServ to free the primary nick after registering under a
+// fallback.
+func (c *Client) regain() {
+	primary := c.PrimaryNick()
+	if c.regainMethod == "" || c.isMe(primary) {
+		return
+	}
+	c.logger.Printf("Asking NickServ to %s %s", strings.ToLower(c.regainMethod), primary)
+	c.send("PRIVMSG NickServ :%s %s %s", c.regainMethod, primary, c.regainPassword)
+	if c.regainMethod == RegainGhost {
+		c.mu.Lock()
+		c.regainTimer = time.AfterFunc(ghostDelay, func() { c.send("NICK %s", primary) })
+		c.mu.Unlock()
+	}
+}
+
+// stopRegain cancels a pending nick change from regain when the connection
+// it was meant for ends.
+func (c *Client) stopRegain() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.regainTimer != nil {
+		c.regainTimer.Stop()
+		c.regainTimer = nil
+	}
+}
+
+// reclaimLoop periodically tries to switch back to the primary nick until
+// done is closed.
+func (c *Client) reclaimLoop(done <-chan struct{}) {
+	interval := c.reclaimInterval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.mu.Lock()
+			registered, primary := c.isRegistered, c.primaryNick
+			c.mu.Unlock()
+			if registered && primary != "" && !c.isMe(primary) {
+				c.send("NICK %s", primary)
+			}
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package irc
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// scriptConn reads a fixed script and records the lines written to it.
+type scriptConn struct {
+	io.Reader
+
+	mu      sync.Mutex
+	written []string
+}
+
+func (s *scriptConn) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.written = append(s.written, strings.TrimSuffix(string(p), "\r\n"))
+	return len(p), nil
+}
+
+func (s *scriptConn) lines() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.written...)
+}
+
+func TestGhostStopsWithConnection(t *testing.T) {
+	defer func(d time.Duration) { ghostDelay = d }(ghostDelay)
+	ghostDelay = 20 * time.Millisecond
+
+	conn := &scriptConn{Reader: strings.NewReader(
+		":irc.test 433 * shelbot :Nickname is already in use\r\n" +
+			":irc.test 001 shelbot_ :Welcome\r\n")}
+	c := New(conn, WithNickServRegain(RegainGhost, "pw"))
+	go func() {
+		for range c.Messages() {
+		}
+	}()
+	if err := c.Connect("shelbot", "Shelbot"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Run(context.Background()); err == nil {
+		t.Fatal("Run returned nil after the connection closed")
+	}
+
+	ghost := "PRIVMSG NickServ :GHOST shelbot pw"
+	deadline := time.Now().Add(time.Second)
+	for !contains(conn.lines(), ghost) {
+		if time.Now().After(deadline) {
+			t.Fatalf("never sent %q, wrote %q", ghost, conn.lines())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(5 * ghostDelay)
+
+	lines := conn.lines()
+	for _, line := range lines[indexOf(lines, ghost):] {
+		if line == "NICK shelbot" {
+			t.Fatalf("took the primary nick after the connection ended: %q", lines)
+		}
+	}
+}
+
+func contains(lines []string, line string) bool { return indexOf(lines, line) >= 0 }
+
+func indexOf(lines []string, line string) int {
+	for i, l := range lines {
+		if l == line {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,51 @@
+package irc
+
+import "context"
+
+// Notice is a NOTICE received from a user or the server. Automated replies
+// must never be sent in response to a notice, so notices are delivered to
+// OnNotice handlers rather than alongside private messages.
+type Notice struct {
+	Source Source
+	Target string
+	Text   string
+	Tags   map[string]string
+	// CTCP is set for CTCP replies, such as the answer to a VERSION query.
+	CTCP *CTCP
+}
+
+// Notice queues text to be sent to target as a NOTICE, dropping lines still
+// queued when ctx is done.
+func (c *Client) Notice(ctx context.Context, target string, text string, opts ...SendOption) error {
+	return c.sendText(ctx, "NOTICE", target, text, "", "", opts...)
+}
+
+func noticeFromMessage(m *Message) (*Notice, error) {
+	if len(m.Params) < 2 {
+		return nil, ErrMissingParams
+	}
+	n := &Notice{
+		Source: m.Source,
+		Target: m.Params[0],
+		Text:   m.Params[1],
+		Tags:   m.Tags,
+	}
+	if ctcp, ok := decodeCTCP(n.Text); ok {
+		n.CTCP = ctcp
+		n.Text = ctcp.Params
+	}
+	return n, nil
+}
+
+// OnNotice registers h to be called for every NOTICE received.
+func (c *Client) OnNotice(h func(*Client, *Notice)) {
+	c.Handle("NOTICE", func(c *Client, m *Message) {
+		n, err := noticeFromMessage(m)
+		if err != nil {
+			c.logger.Println("Error parsing NOTICE:", err)
+			return
+		}
+		n.Text = c.stripText(n.Text)
+		h(c, n)
+	})
+}
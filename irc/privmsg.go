@@ -2,32 +2,77 @@ package irc
 
 import (
 	"strings"
+	"time"
+
+	"github.com/davidjpeacock/shelbot/irc/format"
 )
 
+// WithStripFormatting removes colors, bold and other formatting codes from
+// the text of private messages and notices before they are delivered.
+func WithStripFormatting() Option {
+	return func(c *Client) { c.stripFormatting = true }
+}
+
+func (c *Client) stripText(text string) string {
+	if c.stripFormatting {
+		return format.Strip(text)
+	}
+	return text
+}
+
 type PrivateMessage struct {
 	User         string
 	Nick         string
 	Channel      string
 	Text         string
 	ReplyChannel string
+	Tags         map[string]string
+	// CTCP is set if the message was a CTCP request, in which case Text
+	// holds its parameters, e.g. what was done for an ACTION.
+	CTCP *CTCP
+	// Time is when the message was sent according to the server-time tag,
+	// or else when it was received.
+	Time time.Time
+	// Playback is set for history played back by the server or a bouncer.
+	Playback bool
+	// ID is the message's msgid tag, which can be passed to ReplyTo.
+	ID string
+	// Account is the sender's services account, from the account tag or
+	// the client's channel state. It is empty if the sender is not logged
+	// in or the server does not say.
+	Account string
 }
 
-func privMsgFromMessage(m *Message) (p *PrivateMessage) {
-	p = &PrivateMessage{}
-	if sourceParts := strings.SplitN(m.Origin, "!", 2); len(sourceParts) == 2 {
-		p.Nick = sourceParts[0]
-		p.User = sourceParts[1]
+func privMsgFromMessage(m *Message, chanTypes string) (*PrivateMessage, error) {
+	if len(m.Params) < 2 {
+		return nil, ErrMissingParams
+	}
+
+	p := &PrivateMessage{
+		Nick:    m.Source.Nick,
+		Channel: m.Params[0],
+		Text:    m.Params[1],
+		Tags:    m.Tags,
+		ID:      m.Tags["msgid"],
+		Account: m.Tags["account"],
+	}
+	if ctcp, ok := decodeCTCP(p.Text); ok {
+		p.CTCP = ctcp
+		p.Text = ctcp.Params
+	}
+	if t, ok := m.Time(); ok {
+		p.Time = t
 	} else {
-		p.Nick = m.Origin
+		p.Time = time.Now()
+	}
+	if m.Source.User != "" || m.Source.Host != "" {
+		p.User = m.Source.User + "@" + m.Source.Host
 	}
-	channelAndText := strings.SplitN(m.Parameters, ":", 2)
-	p.Channel = strings.TrimSpace(channelAndText[0])
-	p.Text = channelAndText[1]
-	if !strings.HasPrefix(p.Channel, "#") {
+	if p.Channel == "" || !strings.ContainsRune(chanTypes, rune(p.Channel[0])) {
 		p.ReplyChannel = p.Nick
 	} else {
 		p.ReplyChannel = p.Channel
 	}
 
-	return
+	return p, nil
 }
@@ -0,0 +1,280 @@
+package irc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrDisconnected is returned by queries still waiting for an answer when the
+// connection is lost.
+var ErrDisconnected = errors.New("irc: disconnected")
+
+// QueryError is returned by a query the server answered with an error, such
+// as ERR_NOSUCHNICK (401) for a WHOIS of a nick nobody is using.
+type QueryError struct {
+	Code    int
+	Message string
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("irc: query failed (%03d): %s", e.Code, e.Message)
+}
+
+// query collects the numeric replies to a command sent to the server. Servers
+// answer commands in the order they were sent, so each reply goes to the
+// oldest pending query it matches.
+type query struct {
+	target string
+	// replies are collected until one of end, which is collected too, or
+	// one of errors arrives. Replies and errors give the target as their
+	// second parameter, after our nick; replies to WHO do not, so
+	// anyTarget skips the check for them.
+	replies   []string
+	end       []string
+	errors    []string
+	anyTarget bool
+
+	messages []*Message
+	err      error
+	done     chan struct{}
+}
+
+func hasCode(codes []string, command string) bool {
+	for _, code := range codes {
+		if code == command {
+			return true
+		}
+	}
+	return false
+}
+
+// query sends a command and waits until q has been answered or ctx is done.
+func (c *Client) query(ctx context.Context, q *query, format string, args ...interface{}) ([]*Message, error) {
+	q.done = make(chan struct{})
+	c.queryMu.Lock()
+	c.queries = append(c.queries, q)
+	c.queryMu.Unlock()
+
+	if err := c.send(format, args...); err != nil {
+		c.removeQuery(q)
+		return nil, err
+	}
+	select {
+	case <-q.done:
+		return q.messages, q.err
+	case <-ctx.Done():
+		c.removeQuery(q)
+		return nil, ctx.Err()
+	}
+}
+
+func (c *Client) removeQuery(q *query) {
+	c.queryMu.Lock()
+	defer c.queryMu.Unlock()
+	for i, pending := range c.queries {
+		if pending == q {
+			c.queries = append(c.queries[:i], c.queries[i+1:]...)
+			return
+		}
+	}
+}
+
+// answerQueries passes numeric replies to the pending query they answer.
+func (c *Client) answerQueries(_ *Client, m *Message) {
+	if m.ReplyCode == 0 {
+		return
+	}
+	c.queryMu.Lock()
+	defer c.queryMu.Unlock()
+	for i, q := range c.queries {
+		forTarget := c.EqualFold(m.Param(1), q.target)
+		switch {
+		case hasCode(q.errors, m.Command) && forTarget:
+			q.err = &QueryError{Code: m.ReplyCode, Message: m.Param(len(m.Params) - 1)}
+		case hasCode(q.end, m.Command) && forTarget:
+			q.messages = append(q.messages, m)
+		case hasCode(q.replies, m.Command) && (forTarget || q.anyTarget):
+			q.messages = append(q.messages, m)
+			return
+		default:
+			continue
+		}
+		c.queries = append(c.queries[:i], c.queries[i+1:]...)
+		close(q.done)
+		return
+	}
+}
+
+// failQueries ends all pending queries with err.
+func (c *Client) failQueries(err error) {
+	c.queryMu.Lock()
+	defer c.queryMu.Unlock()
+	for _, q := range c.queries {
+		q.err = err
+		close(q.done)
+	}
+	c.queries = nil
+}
+
+// WhoisInfo is the server's answer to a WHOIS.
+type WhoisInfo struct {
+	Nick       string
+	User       string
+	Host       string
+	RealName   string
+	Server     string
+	ServerInfo string
+	// Account is the services account the user is logged in to, if any.
+	Account string
+	// Channels are the channels the user is visibly on, each with the
+	// user's status prefix, e.g. "@#ops".
+	Channels []string
+	Away     string
+	Operator bool
+	Idle     time.Duration
+	SignOn   time.Time
+}
+
+// Whois asks the server about nick and waits for the answer. If nobody is
+// using nick the error is a *QueryError with code 401.
+func (c *Client) Whois(ctx context.Context, nick string) (*WhoisInfo, error) {
+	messages, err := c.query(ctx, &query{
+		target:  nick,
+		replies: []string{"301", "311", "312", "313", "317", "319", "330"},
+		end:     []string{"318"},
+		errors:  []string{"401", "402"},
+	}, "WHOIS %s", nick)
+	if err != nil {
+		return nil, err
+	}
+	info := &WhoisInfo{Nick: nick}
+	for _, m := range messages {
+		switch m.ReplyCode {
+		case 301: // <nick> :<away message>
+			info.Away = m.Param(2)
+		case 311: // <nick> <user> <host> * :<real name>
+			info.Nick = m.Param(1)
+			info.User = m.Param(2)
+			info.Host = m.Param(3)
+			info.RealName = m.Param(5)
+		case 312: // <nick> <server> :<server info>
+			info.Server = m.Param(2)
+			info.ServerInfo = m.Param(3)
+		case 313:
+			info.Operator = true
+		case 317: // <nick> <idle seconds> [<signon>] :seconds idle
+			if idle, err := strconv.Atoi(m.Param(2)); err == nil {
+				info.Idle = time.Duration(idle) * time.Second
+			}
+			if len(m.Params) > 4 {
+				if signOn, err := strconv.ParseInt(m.Param(3), 10, 64); err == nil {
+					info.SignOn = time.Unix(signOn, 0)
+				}
+			}
+		case 319: // <nick> :<channels>
+			info.Channels = append(info.Channels, strings.Fields(m.Param(2))...)
+		case 330: // <nick> <account> :is logged in as
+			info.Account = m.Param(2)
+		}
+	}
+	return info, nil
+}
+
+// WhoReply is one user matched by a WHO.
+type WhoReply struct {
+	// Channel is one of the channels the user is on, or "*".
+	Channel  string
+	User     string
+	Host     string
+	Server   string
+	Nick     string
+	Away     bool
+	Operator bool
+	// Prefix holds the user's status in Channel, e.g. "@".
+	Prefix   string
+	Hops     int
+	RealName string
+}
+
+// Who lists the users matching mask, which may be a channel, and waits for
+// the answer.
+func (c *Client) Who(ctx context.Context, mask string) ([]WhoReply, error) {
+	messages, err := c.query(ctx, &query{
+		target:    mask,
+		replies:   []string{"352"},
+		end:       []string{"315"},
+		errors:    []string{"401", "403"},
+		anyTarget: true,
+	}, "WHO %s", mask)
+	if err != nil {
+		return nil, err
+	}
+	var replies []WhoReply
+	for _, m := range messages {
+		if m.ReplyCode != 352 {
+			continue
+		}
+		// <channel> <user> <host> <server> <nick> <flags> :<hops> <real name>
+		r := WhoReply{
+			Channel: m.Param(1),
+			User:    m.Param(2),
+			Host:    m.Param(3),
+			Server:  m.Param(4),
+			Nick:    m.Param(5),
+		}
+		flags := m.Param(6)
+		r.Away = strings.HasPrefix(flags, "G")
+		flags = strings.TrimLeft(flags, "HG")
+		r.Operator = strings.HasPrefix(flags, "*")
+		r.Prefix = strings.TrimPrefix(flags, "*")
+		hops := strings.SplitN(m.Param(7), " ", 2)
+		r.Hops, _ = strconv.Atoi(hops[0])
+		if len(hops) > 1 {
+			r.RealName = hops[1]
+		}
+		replies = append(replies, r)
+	}
+	return replies, nil
+}
+
+// ChannelModes asks the server for the modes of channel and waits for the
+// answer.
+func (c *Client) ChannelModes(ctx context.Context, channel string) (*Mode, error) {
+	messages, err := c.query(ctx, &query{
+		target: channel,
+		end:    []string{"324"},
+		errors: []string{"401", "403", "442"},
+	}, "MODE %s", channel)
+	if err != nil {
+		return nil, err
+	}
+	// <channel> <modes> [<args>...]
+	m := messages[0]
+	mode := &Mode{Target: m.Param(1), Modes: m.Param(2)}
+	if len(m.Params) > 3 {
+		mode.Args = m.Params[3:]
+	}
+	return mode, nil
+}
+
+// Topic asks the server for the topic of channel and waits for the answer.
+// The topic is empty if none is set.
+func (c *Client) Topic(ctx context.Context, channel string) (string, error) {
+	messages, err := c.query(ctx, &query{
+		target: channel,
+		end:    []string{"331", "332"},
+		errors: []string{"403", "442"},
+	}, "TOPIC %s", channel)
+	if err != nil {
+		return "", err
+	}
+	// 331 <channel> :No topic is set, or 332 <channel> :<topic>
+	if m := messages[0]; m.ReplyCode == 332 {
+		return m.Param(2), nil
+	}
+	return "", nil
+}
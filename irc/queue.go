@@ -0,0 +1,261 @@
+package irc
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrQueueFull = errors.New("irc: send queue full")
+
+// maxQueuedLines bounds how many lines may wait for a single target.
+const maxQueuedLines = 256
+
+// WithRateLimit sets the outbound flood control: up to burst lines are sent
+// back to back, after which one line is sent per interval. The defaults of 5
+// lines and 1 second stay within the limits of common IRC servers.
+func WithRateLimit(burst int, interval time.Duration) Option {
+	return func(c *Client) {
+		if burst < 1 {
+			burst = 1
+		}
+		c.bucket = newTokenBucket(burst, interval)
+	}
+}
+
+// WithPause sends lines one at a time, pause apart.
+func WithPause(pause time.Duration) Option {
+	return WithRateLimit(1, pause)
+}
+
+// WithSendTimeout drops messages that are still queued timeout after they
+// were sent, e.g. because flood control held them up. By default they wait
+// until written or until the context passed to Send is done.
+func WithSendTimeout(timeout time.Duration) Option {
+	return func(c *Client) { c.sendTimeout = timeout }
+}
+
+// tokenBucket refills one token per interval up to burst tokens. Each line
+// written takes one token.
+type tokenBucket struct {
+	burst    int
+	interval time.Duration
+	tokens   float64
+	last     time.Time
+}
+
+func newTokenBucket(burst int, interval time.Duration) *tokenBucket {
+	return &tokenBucket{burst: burst, interval: interval, tokens: float64(burst)}
+}
+
+// take consumes a token and returns how long to wait before using it. A nil
+// bucket has no limit.
+func (b *tokenBucket) take(now time.Time) time.Duration {
+	if b == nil || b.interval <= 0 {
+		return 0
+	}
+	if !b.last.IsZero() {
+		b.tokens += float64(now.Sub(b.last)) / float64(b.interval)
+		if b.tokens > float64(b.burst) {
+			b.tokens = float64(b.burst)
+		}
+	}
+	b.last = now
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens * float64(b.interval))
+}
+
+// queuedLine is a line waiting to be written. It is dropped if its context
+// is done or its deadline passes before its turn comes.
+type queuedLine struct {
+	ctx      context.Context
+	deadline time.Time
+	text     string
+	priority bool
+}
+
+func (l queuedLine) expired() bool {
+	if !l.deadline.IsZero() && time.Now().After(l.deadline) {
+		return true
+	}
+	return l.ctx != nil && l.ctx.Err() != nil
+}
+
+// sendQueue holds lines waiting to be written. Protocol lines are sent ahead
+// of everything else, while messages are queued per target and served round
+// robin so that one long reply does not hold up other channels.
+type sendQueue struct {
+	mu       sync.Mutex
+	priority []queuedLine
+	targets  map[string][]queuedLine
+	order    []string
+	wake     chan struct{}
+	// writing is set while a popped line is being written.
+	writing bool
+}
+
+func newSendQueue() *sendQueue {
+	return &sendQueue{
+		targets: make(map[string][]queuedLine),
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+func (q *sendQueue) pushPriority(line string) {
+	q.mu.Lock()
+	q.priority = append(q.priority, queuedLine{text: line, priority: true})
+	q.mu.Unlock()
+	q.signal()
+}
+
+func (q *sendQueue) push(ctx context.Context, deadline time.Time, target string, lines ...string) error {
+	q.mu.Lock()
+	pending, ok := q.targets[target]
+	if len(pending)+len(lines) > maxQueuedLines {
+		q.mu.Unlock()
+		return ErrQueueFull
+	}
+	if !ok {
+		q.order = append(q.order, target)
+	}
+	for _, line := range lines {
+		pending = append(pending, queuedLine{ctx: ctx, deadline: deadline, text: line})
+	}
+	q.targets[target] = pending
+	q.mu.Unlock()
+	q.signal()
+	return nil
+}
+
+func (q *sendQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// pop returns the next line to write, if any.
+func (q *sendQueue) pop() (queuedLine, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.priority) > 0 {
+		line := q.priority[0]
+		q.priority = q.priority[1:]
+		q.writing = true
+		return line, true
+	}
+	if len(q.order) == 0 {
+		return queuedLine{}, false
+	}
+	q.writing = true
+
+	target := q.order[0]
+	q.order = q.order[1:]
+	pending := q.targets[target]
+	line := pending[0]
+	if len(pending) > 1 {
+		q.targets[target] = pending[1:]
+		q.order = append(q.order, target)
+	} else {
+		delete(q.targets, target)
+	}
+	return line, true
+}
+
+// done marks the line returned by pop as written or dropped.
+func (q *sendQueue) done() {
+	q.mu.Lock()
+	q.writing = false
+	q.mu.Unlock()
+}
+
+// idle reports whether everything queued has been written.
+func (q *sendQueue) idle() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return !q.writing && len(q.priority) == 0 && len(q.order) == 0
+}
+
+// clear discards everything queued, e.g. after the connection was lost.
+func (q *sendQueue) clear() {
+	q.mu.Lock()
+	q.priority = nil
+	q.targets = make(map[string][]queuedLine)
+	q.order = nil
+	q.mu.Unlock()
+}
+
+// writeLoop writes queued lines to the connection, respecting the rate
+// limit, until the client quits or the context passed to Run is cancelled.
+// Lines whose context or deadline expired while queued are dropped.
+func (c *Client) writeLoop() {
+	defer close(c.writerDone)
+	for {
+		line, ok := c.queue.pop()
+		if !ok {
+			select {
+			case <-c.queue.wake:
+				continue
+			case <-c.quit:
+				return
+			case <-c.stopped:
+				return
+			}
+		}
+		if line.expired() {
+			c.logger.Println("Dropping expired line:", line.text)
+			c.queue.done()
+			continue
+		}
+
+		// Registration only takes a few lines, and the server is
+		// waiting for them.
+		c.mu.Lock()
+		bucket, registering := c.bucket, !c.isRegistered
+		c.mu.Unlock()
+		if line.priority && registering {
+			bucket = nil
+		}
+		if delay := bucket.take(time.Now()); delay > 0 {
+			t := time.NewTimer(delay)
+			select {
+			case <-t.C:
+			case <-c.quit:
+				t.Stop()
+				return
+			case <-c.stopped:
+				t.Stop()
+				return
+			}
+		}
+
+		if line.expired() {
+			c.logger.Println("Dropping expired line:", line.text)
+		} else if err := c.writeLine(line.text); err != nil {
+			c.logger.Println("Error writing to server:", err)
+		}
+		c.queue.done()
+	}
+}
+
+// Flush waits until everything queued has been written or dropped, or ctx
+// is done.
+func (c *Client) Flush(ctx context.Context) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for !c.queue.idle() {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-c.quit:
+			return errors.New("irc: client has quit")
+		}
+	}
+	return nil
+}
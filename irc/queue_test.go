@@ -0,0 +1,95 @@
+package irc
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSendQueueRoundRobin(t *testing.T) {
+	q := newSendQueue()
+	q.push(context.Background(), time.Time{}, "#a", "a1", "a2", "a3")
+	q.push(context.Background(), time.Time{}, "#b", "b1")
+	q.pushPriority("PONG :x")
+
+	var got []string
+	for {
+		line, ok := q.pop()
+		if !ok {
+			break
+		}
+		got = append(got, line.text)
+	}
+	want := []string{"PONG :x", "a1", "b1", "a2", "a3"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("written in order %q, want %q", got, want)
+	}
+}
+
+func TestResetRefillsBucket(t *testing.T) {
+	c := New(nil, WithRateLimit(2, time.Hour))
+	defer c.Quit("")
+	now := time.Now()
+	c.bucket.take(now)
+	c.bucket.take(now)
+	if delay := c.bucket.take(now); delay == 0 {
+		t.Fatal("bucket not drained")
+	}
+
+	c.reset(nil)
+	if delay := c.bucket.take(now); delay != 0 {
+		t.Errorf("first line after reset waits %s", delay)
+	}
+}
+
+func TestSendTimeout(t *testing.T) {
+	conn := &scriptConn{Reader: strings.NewReader("")}
+	c := New(conn, WithRateLimit(1, 400*time.Millisecond), WithSendTimeout(300*time.Millisecond))
+	defer c.Quit("")
+
+	// "two" has to wait for flood control longer than the timeout allows,
+	// while "three" is sent once there is room again.
+	ctx := context.Background()
+	c.Send(ctx, "#a", "one")
+	c.Send(ctx, "#a", "two")
+	time.Sleep(600 * time.Millisecond)
+	c.Send(ctx, "#a", "three")
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !contains(conn.lines(), "PRIVMSG #a :three") {
+		if time.Now().After(deadline) {
+			t.Fatalf("never sent three, wrote %q", conn.lines())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	want := []string{"PRIVMSG #a :one", "PRIVMSG #a :three"}
+	if got := conn.lines(); !reflect.DeepEqual(got, want) {
+		t.Errorf("wrote %q, want %q", got, want)
+	}
+}
+
+func TestWriterStopsWithRun(t *testing.T) {
+	server, conn := net.Pipe()
+	defer server.Close()
+	c := New(conn)
+	go func() {
+		for range c.Messages() {
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- c.Run(ctx) }()
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("Run returned %v, want %v", err, context.Canceled)
+	}
+	select {
+	case <-c.writerDone:
+	case <-time.After(time.Second):
+		t.Fatal("writer still running after Run returned")
+	}
+}
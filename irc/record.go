@@ -0,0 +1,141 @@
+package irc
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Recordings have one line per message, e.g.
+//
+//	2017-03-01T12:00:00.000Z << :alice!~a@example.com PRIVMSG #shelbot :hi
+//	2017-03-01T12:00:00.250Z >> PRIVMSG #shelbot :hello alice
+//
+// where << marks lines received and >> lines sent.
+const (
+	recordTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+	recordIn         = "<<"
+	recordOut        = ">>"
+)
+
+// WithRecorder writes every raw line received and sent to w, along with the
+// time. Passwords are left out. The recording can be played back with
+// NewReplay.
+func WithRecorder(w io.Writer) Option {
+	return func(c *Client) { c.recorder = w }
+}
+
+func (c *Client) record(direction, line string) {
+	if c.recorder == nil {
+		return
+	}
+	if direction == recordOut {
+		line = redact(line)
+	}
+	c.recordMu.Lock()
+	defer c.recordMu.Unlock()
+	fmt.Fprintf(c.recorder, "%s %s %s\n", time.Now().Format(recordTimeFormat), direction, line)
+}
+
+// redact hides the credentials in a line sent to the server so recordings
+// can be shared.
+func redact(line string) string {
+	m, err := ParseMessage(line)
+	if err != nil {
+		return line
+	}
+	switch {
+	case m.Command == "PASS":
+		return "PASS <redacted>"
+	case m.Command == "AUTHENTICATE" && m.Param(0) != SASLPlain && m.Param(0) != SASLExternal && m.Param(0) != "+":
+		return "AUTHENTICATE <redacted>"
+	case m.Command == "PRIVMSG" && strings.EqualFold(m.Param(0), "NickServ"):
+		return "PRIVMSG " + m.Param(0) + " :<redacted>"
+	}
+	return line
+}
+
+// Replay is a connection that plays back what was received in a recording
+// made with WithRecorder. Reads return io.EOF once the recording has been
+// played, and lines written by the client are kept for inspection with
+// passwords left out, as the client authenticates again during playback.
+type Replay struct {
+	mu      sync.Mutex
+	pending []byte
+	written []string
+	closed  bool
+}
+
+// NewReplay reads a recording for playback.
+func NewReplay(recording io.Reader) (*Replay, error) {
+	r := &Replay{}
+	scanner := bufio.NewScanner(recording)
+	for n := 1; scanner.Scan(); n++ {
+		if scanner.Text() == "" {
+			continue
+		}
+		fields := strings.SplitN(scanner.Text(), " ", 3)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("irc: recording line %d: malformed", n)
+		}
+		if _, err := time.Parse(recordTimeFormat, fields[0]); err != nil {
+			return nil, fmt.Errorf("irc: recording line %d: %v", n, err)
+		}
+		switch fields[1] {
+		case recordIn:
+			r.pending = append(r.pending, fields[2]+"\r\n"...)
+		case recordOut:
+		default:
+			return nil, fmt.Errorf("irc: recording line %d: unknown direction %q", n, fields[1])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Replay) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if len(r.pending) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+func (r *Replay) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return 0, io.ErrClosedPipe
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(string(p), "\r\n"), "\r\n") {
+		r.written = append(r.written, redact(line))
+	}
+	return len(p), nil
+}
+
+// Close stops playback.
+func (r *Replay) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	return nil
+}
+
+// Written returns the lines the client has sent, without CRLF and with
+// passwords redacted.
+func (r *Replay) Written() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.written...)
+}
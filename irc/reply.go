@@ -0,0 +1,32 @@
+package irc
+
+// SendOption changes how a message is sent by Send, Notice or Action.
+type SendOption func(*sendOptions)
+
+type sendOptions struct {
+	tags map[string]string
+}
+
+// ReplyTo marks the message as a reply to the message with the given ID, as
+// found in PrivateMessage.ID, so that clients can show it as part of a
+// thread. It has no effect if the ID is empty or the server has not enabled
+// message-tags.
+func ReplyTo(msgid string) SendOption {
+	return func(o *sendOptions) {
+		if msgid != "" {
+			o.tags["+draft/reply"] = msgid
+		}
+	}
+}
+
+// tagPrefix returns the tags to prefix each line sent with opts.
+func (c *Client) tagPrefix(opts []SendOption) string {
+	if len(opts) == 0 || !c.HasCapability(CapMessageTags) {
+		return ""
+	}
+	o := sendOptions{tags: make(map[string]string)}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return formatTags(o.tags)
+}
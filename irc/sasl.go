@@ -0,0 +1,147 @@
+package irc
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+const (
+	SASLPlain    = "PLAIN"
+	SASLExternal = "EXTERNAL"
+)
+
+// SASLError is returned from Run when the server rejects the client's
+// SASL authentication and registration cannot continue.
+type SASLError struct {
+	Code    int
+	Message string
+}
+
+func (e *SASLError) Error() string {
+	return fmt.Sprintf("irc: SASL authentication failed (%03d): %s", e.Code, e.Message)
+}
+
+type saslConfig struct {
+	mechanism string
+	account   string
+	password  string
+}
+
+// WithSASLPlain authenticates with the given services account and password.
+// If the server does not support SASL PLAIN the client falls back to
+// identifying with NickServ once registered.
+func WithSASLPlain(account, password string) Option {
+	return func(c *Client) {
+		c.sasl = &saslConfig{mechanism: SASLPlain, account: account, password: password}
+		c.wantCaps = append(c.wantCaps, "sasl")
+	}
+}
+
+// WithSASLExternal authenticates using the TLS client certificate presented
+// on the connection (CertFP).
+func WithSASLExternal() Option {
+	return func(c *Client) {
+		c.sasl = &saslConfig{mechanism: SASLExternal}
+		c.wantCaps = append(c.wantCaps, "sasl")
+	}
+}
+
+// WithServerPassword sends a PASS command before registering.
+func WithServerPassword(password string) Option {
+	return func(c *Client) { c.serverPass = password }
+}
+
+// Account returns the services account the client is logged in as, if any.
+func (c *Client) Account() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.account
+}
+
+// saslSupported reports whether SASL is configured and the server advertises
+// the configured mechanism. Servers that omit the mechanism list are assumed
+// to support it.
+func (c *Client) saslSupported() bool {
+	if c.sasl == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.caps["sasl"] {
+		return false
+	}
+	mechs := c.availableCaps["sasl"]
+	if mechs == "" {
+		return true
+	}
+	for _, mech := range strings.Split(mechs, ",") {
+		if strings.EqualFold(mech, c.sasl.mechanism) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Client) startSASL() {
+	c.logger.Println("Starting SASL authentication with", c.sasl.mechanism)
+	c.send("AUTHENTICATE %s", c.sasl.mechanism)
+}
+
+func (c *Client) saslPayload() string {
+	if c.sasl.mechanism == SASLExternal {
+		return ""
+	}
+	return c.sasl.account + "\x00" + c.sasl.account + "\x00" + c.sasl.password
+}
+
+// handleAuthenticate responds to the server's AUTHENTICATE challenge. The
+// payload is sent base64 encoded in chunks of 400 bytes, terminated by "+"
+// if the last chunk was exactly 400 bytes long.
+func (c *Client) handleAuthenticate(m *Message) {
+	if c.sasl == nil || m.Param(0) != "+" {
+		return
+	}
+	payload := base64.StdEncoding.EncodeToString([]byte(c.saslPayload()))
+	if payload == "" {
+		c.send("AUTHENTICATE +")
+		return
+	}
+	for len(payload) >= 400 {
+		c.send("AUTHENTICATE %s", payload[:400])
+		payload = payload[400:]
+	}
+	if payload == "" {
+		payload = "+"
+	}
+	c.send("AUTHENTICATE %s", payload)
+}
+
+// handleSASLReply processes the SASL numerics. It returns an error when
+// authentication failed and registration should be aborted.
+func (c *Client) handleSASLReply(m *Message) error {
+	switch m.ReplyCode {
+	case 900: // RPL_LOGGEDIN
+		c.mu.Lock()
+		c.account = m.Param(2)
+		c.mu.Unlock()
+		c.logger.Println("Logged in as", m.Param(2))
+	case 903, 907: // RPL_SASLSUCCESS, ERR_SASLALREADY
+		c.finishCaps()
+	case 902, 904, 905, 906: // ERR_NICKLOCKED, ERR_SASLFAIL, ERR_SASLTOOLONG, ERR_SASLABORTED
+		c.finishCaps()
+		c.writeLine("QUIT")
+		return &SASLError{Code: m.ReplyCode, Message: m.Param(len(m.Params) - 1)}
+	}
+	return nil
+}
+
+// identifyFallback identifies with NickServ when SASL was requested but could
+// not be used on this server.
+func (c *Client) identifyFallback() {
+	if c.sasl == nil || c.sasl.mechanism != SASLPlain || c.Account() != "" {
+		return
+	}
+	c.logger.Println("SASL unavailable, identifying with NickServ")
+	c.send("PRIVMSG NickServ :IDENTIFY %s %s", c.sasl.account, c.sasl.password)
+}
@@ -0,0 +1,127 @@
+package irc
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"github.com/davidjpeacock/shelbot/irc/format"
+)
+
+const (
+	// maxLineLength is the RFC 1459 limit for a line including CRLF.
+	maxLineLength = 512
+	// Until the server tells us our hostmask, assume the longest one allowed
+	// for our nick: a 10 character user name and 63 character host name.
+	maxUserLength = 10
+	maxHostLength = 63
+	ellipsis      = "…"
+)
+
+// WithMaxLines caps the number of lines a single Send produces. Text that
+// would need more lines is cut short and marked with an ellipsis.
+func WithMaxLines(n int) Option {
+	return func(c *Client) { c.maxLines = n }
+}
+
+// textBudget returns how many bytes of text fit in a single command to
+// target once the server has prepended our prefix and added CRLF.
+func (c *Client) textBudget(command, target string) int {
+	c.mu.Lock()
+	lineLen := c.features.LineLen
+	prefix := c.prefix
+	if prefix == "" {
+		prefix = c.nick + "!" + strings.Repeat("x", maxUserLength) + "@" + strings.Repeat("x", maxHostLength)
+	}
+	c.mu.Unlock()
+
+	// ":<prefix> <command> <target> :<text>\r\n"
+	overhead := 1 + len(prefix) + 1 + len(command) + 1 + len(target) + 2 + 2
+	return lineLen - overhead
+}
+
+// learnPrefix records the nick!user@host the server uses for us, taken from
+// any message we are the source of.
+func (c *Client) learnPrefix(m *Message) {
+	if m.Source.User == "" || m.Source.Host == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if FoldCase(c.features.CaseMapping, m.Source.Nick) == FoldCase(c.features.CaseMapping, c.nick) {
+		c.prefix = m.Source.String()
+	}
+}
+
+// lineBreaks turns every kind of line break into "\n" and removes NULs, so
+// that no text can end the IRC line it is sent in early.
+var lineBreaks = strings.NewReplacer("\r\n", "\n", "\r", "\n", "\x00", "")
+
+// splitText breaks text into lines of at most max bytes. Embedded line
+// breaks start a new line, lines are broken at spaces where possible, and
+// never in the middle of a UTF-8 sequence or IRC color code. If maxLines is
+// positive and more lines would be needed, the last line ends with an
+// ellipsis. A max below 1 is treated as 1.
+func splitText(text string, max, maxLines int) []string {
+	if max < 1 {
+		max = 1
+	}
+	var lines []string
+	for _, paragraph := range strings.Split(lineBreaks.Replace(text), "\n") {
+		for len(paragraph) > max {
+			cut := splitPoint(paragraph, max)
+			lines = append(lines, strings.TrimRight(paragraph[:cut], " "))
+			paragraph = strings.TrimLeft(paragraph[cut:], " ")
+		}
+		if paragraph != "" {
+			lines = append(lines, paragraph)
+		}
+	}
+
+	if maxLines > 0 && len(lines) > maxLines {
+		lines = lines[:maxLines]
+		last := lines[maxLines-1]
+		if room := max - len(ellipsis); len(last) > room {
+			if room < 1 {
+				last = ""
+			} else {
+				last = strings.TrimRight(last[:splitPoint(last, room)], " ")
+			}
+		}
+		lines[maxLines-1] = last + ellipsis
+	}
+
+	return lines
+}
+
+// splitPoint returns where to cut s so the first part is at most max bytes.
+func splitPoint(s string, max int) int {
+	cut := max
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	if start, end := formatCodeAt(s, cut); start < cut && cut < end {
+		cut = start
+	}
+
+	if space := strings.LastIndexByte(s[:cut], ' '); space > 0 {
+		return space
+	}
+	if cut == 0 {
+		// Nothing fits; make progress by taking at least one rune.
+		_, size := utf8.DecodeRuneInString(s)
+		return size
+	}
+	return cut
+}
+
+// formatCodeAt finds the color code, if any, spanning position i of s and
+// returns its bounds.
+func formatCodeAt(s string, i int) (start, end int) {
+	// The longest color code is \x04 and two six digit colors.
+	for start = i - 1; start >= 0 && i-start <= 14; start-- {
+		if s[start] == '\x03' || s[start] == '\x04' {
+			return start, start + format.CodeLen(s[start:])
+		}
+	}
+	return i, i
+}
@@ -0,0 +1,115 @@
+package irc
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSplitText(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		max      int
+		maxLines int
+		want     []string
+	}{
+		{
+			name: "short",
+			text: "Karma for bob now 1",
+			max:  100,
+			want: []string{"Karma for bob now 1"},
+		},
+		{
+			name: "spaces",
+			text: "the quick brown fox jumps",
+			max:  10,
+			want: []string{"the quick", "brown fox", "jumps"},
+		},
+		{
+			name: "no spaces",
+			text: "abcdefghijklmnopqrstuvwxyz",
+			max:  10,
+			want: []string{"abcdefghij", "klmnopqrst", "uvwxyz"},
+		},
+		{
+			name: "multibyte",
+			text: "東京都新宿区",
+			max:  8,
+			want: []string{"東京", "都新", "宿区"},
+		},
+		{
+			name: "newlines",
+			text: "first line\r\nsecond line\n\nthird",
+			max:  100,
+			want: []string{"first line", "second line", "third"},
+		},
+		{
+			name: "carriage returns and NULs",
+			text: "hello\rQUIT :pwned\x00\r\nbye",
+			max:  100,
+			want: []string{"hello", "QUIT :pwned", "bye"},
+		},
+		{
+			name: "color code",
+			text: "abcdefg\x0304,12red",
+			max:  10,
+			want: []string{"abcdefg", "\x0304,12red"},
+		},
+		{
+			name:     "max lines",
+			text:     "one two three four five six",
+			max:      9,
+			maxLines: 2,
+			want:     []string{"one two", "three…"},
+		},
+		{
+			name: "negative budget",
+			text: "hello",
+			max:  -1,
+			want: []string{"h", "e", "l", "l", "o"},
+		},
+	}
+
+	for _, tt := range tests {
+		got := splitText(tt.text, tt.max, tt.maxLines)
+		if tt.max < 1 {
+			tt.max = 1
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Fatalf("%s: splitText(%q, %d) = %q, want %q", tt.name, tt.text, tt.max, got, tt.want)
+		}
+		for _, line := range got {
+			if len(line) > tt.max || !utf8.ValidString(line) {
+				t.Fatalf("%s: invalid line %q", tt.name, line)
+			}
+		}
+	}
+}
+
+func TestTextBudget(t *testing.T) {
+	c := New(nil)
+	c.nick = "shelbot"
+
+	guess := c.textBudget("PRIVMSG", "#shelly")
+	c.learnPrefix(&Message{Source: Source{Nick: "shelbot", User: "~shel", Host: "example.com"}})
+	exact := c.textBudget("PRIVMSG", "#shelly")
+
+	line := ":shelbot!~shel@example.com PRIVMSG #shelly :" + strings.Repeat("x", exact) + "\r\n"
+	if len(line) != maxLineLength {
+		t.Fatalf("budget %d gives a %d byte line", exact, len(line))
+	}
+	if guess >= exact {
+		t.Fatalf("budget before learning the prefix (%d) should be below %d", guess, exact)
+	}
+}
+
+func TestSplitTextTinyBudget(t *testing.T) {
+	// Lines may end up longer than a budget below 1, but must not panic.
+	for _, max := range []int{-5, 0, 1, 2} {
+		if got := splitText("one two three", max, 2); len(got) != 2 {
+			t.Errorf("splitText with max %d and 2 lines = %q", max, got)
+		}
+	}
+}
@@ -0,0 +1,407 @@
+package irc
+
+import (
+	"sort"
+	"strings"
+)
+
+// Member is a user present in a channel.
+type Member struct {
+	Nick string
+	User string
+	Host string
+	// Prefixes are the member's channel status symbols, e.g. "@+", from
+	// highest to lowest rank.
+	Prefixes string
+	// Account is the services account the member is logged in to, if known.
+	// It requires the extended-join and account-notify capabilities.
+	Account string
+}
+
+// ChannelState is a snapshot of a channel the client is in.
+type ChannelState struct {
+	Name    string
+	Topic   string
+	Modes   map[string]string
+	Members []Member
+}
+
+type channelState struct {
+	name    string
+	topic   string
+	modes   map[string]string
+	members map[string]*Member
+	// names collects the members from RPL_NAMREPLY until RPL_ENDOFNAMES
+	// replaces members with it.
+	names map[string]*Member
+}
+
+func newChannelState(name string) *channelState {
+	return &channelState{
+		name:    name,
+		modes:   make(map[string]string),
+		members: make(map[string]*Member),
+	}
+}
+
+// trackState registers the handlers that keep channel state up to date.
+func (c *Client) trackState() {
+	c.Handle("005", c.handleISupport)
+	c.Handle("JOIN", c.stateJoin)
+	c.Handle("ACCOUNT", c.stateAccount)
+	c.Handle("PART", c.statePart)
+	c.Handle("KICK", c.stateKick)
+	c.Handle("QUIT", c.stateQuit)
+	c.Handle("NICK", c.stateNick)
+	c.Handle("MODE", c.stateMode)
+	c.Handle("TOPIC", c.stateTopic)
+	c.Handle("324", c.stateChannelModes)
+	c.Handle("331", c.stateTopic)
+	c.Handle("332", c.stateTopic)
+	c.Handle("353", c.stateNames)
+	c.Handle("366", c.stateEndOfNames)
+}
+
+func (c *Client) resetState() {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	c.channels = make(map[string]*channelState)
+}
+
+func (c *Client) isMe(nick string) bool {
+	return c.FoldCase(nick) == c.FoldCase(c.Nick())
+}
+
+func (c *Client) channelState(name string) *channelState {
+	return c.channels[c.FoldCase(name)]
+}
+
+func (c *Client) stateJoin(_ *Client, m *Message) {
+	name := m.Param(0)
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	if c.isMe(m.Source.Nick) {
+		c.channels[c.FoldCase(name)] = newChannelState(name)
+	}
+	if ch := c.channelState(name); ch != nil {
+		ch.members[c.FoldCase(m.Source.Nick)] = &Member{Nick: m.Source.Nick, User: m.Source.User, Host: m.Source.Host, Account: joinAccount(m)}
+	}
+}
+
+// joinAccount returns the account of a user joining a channel, given by
+// extended-join as JOIN <channel> <account> :<real name> or by the account
+// tag. An account of "*" means the user is not logged in.
+func joinAccount(m *Message) string {
+	account := m.Tags["account"]
+	if len(m.Params) >= 3 {
+		account = m.Param(1)
+	}
+	if account == "*" {
+		return ""
+	}
+	return account
+}
+
+// stateAccount follows users logging in and out with account-notify, which
+// sends ACCOUNT <account>, or ACCOUNT * on logout.
+func (c *Client) stateAccount(_ *Client, m *Message) {
+	account := m.Param(0)
+	if account == "*" {
+		account = ""
+	}
+	key := c.FoldCase(m.Source.Nick)
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	for _, ch := range c.channels {
+		if member, ok := ch.members[key]; ok {
+			member.Account = account
+		}
+	}
+}
+
+func (c *Client) removeMember(channel, nick string) {
+	if c.isMe(nick) {
+		delete(c.channels, c.FoldCase(channel))
+		return
+	}
+	if ch := c.channelState(channel); ch != nil {
+		delete(ch.members, c.FoldCase(nick))
+	}
+}
+
+func (c *Client) statePart(_ *Client, m *Message) {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	c.removeMember(m.Param(0), m.Source.Nick)
+}
+
+func (c *Client) stateKick(_ *Client, m *Message) {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	c.removeMember(m.Param(0), m.Param(1))
+}
+
+func (c *Client) stateQuit(_ *Client, m *Message) {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	for _, ch := range c.channels {
+		delete(ch.members, c.FoldCase(m.Source.Nick))
+	}
+}
+
+func (c *Client) stateNick(_ *Client, m *Message) {
+	oldKey, newNick := c.FoldCase(m.Source.Nick), m.Param(0)
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	for _, ch := range c.channels {
+		if member, ok := ch.members[oldKey]; ok {
+			delete(ch.members, oldKey)
+			member.Nick = newNick
+			ch.members[c.FoldCase(newNick)] = member
+		}
+	}
+}
+
+func (c *Client) stateTopic(_ *Client, m *Message) {
+	// TOPIC <channel> :<topic>, or 331/332 <nick> <channel> [:<topic>].
+	params := m.Params
+	if m.ReplyCode != 0 && len(params) > 0 {
+		params = params[1:]
+	}
+	if len(params) == 0 {
+		return
+	}
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	if ch := c.channelState(params[0]); ch != nil {
+		ch.topic = ""
+		if m.ReplyCode != 331 && len(params) > 1 {
+			ch.topic = params[1]
+		}
+	}
+}
+
+func (c *Client) stateMode(_ *Client, m *Message) {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	if ch := c.channelState(m.Param(0)); ch != nil && len(m.Params) > 1 {
+		c.applyModes(ch, m.Params[1], m.Params[2:])
+	}
+}
+
+func (c *Client) stateChannelModes(_ *Client, m *Message) {
+	// 324 <nick> <channel> <modes> [<args>...]
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	if ch := c.channelState(m.Param(1)); ch != nil && len(m.Params) > 2 {
+		ch.modes = make(map[string]string)
+		c.applyModes(ch, m.Params[2], m.Params[3:])
+	}
+}
+
+// applyModes applies a mode change such as "+o-v+l nick1 nick2 10",
+// consuming arguments as described by the server's CHANMODES and PREFIX.
+func (c *Client) applyModes(ch *channelState, modes string, args []string) {
+	features := c.Features()
+	adding := true
+	nextArg := func() string {
+		if len(args) == 0 {
+			return ""
+		}
+		arg := args[0]
+		args = args[1:]
+		return arg
+	}
+
+	for _, mode := range modes {
+		switch {
+		case mode == '+':
+			adding = true
+		case mode == '-':
+			adding = false
+		case strings.ContainsRune(features.PrefixModes, mode):
+			nick := nextArg()
+			if member, ok := ch.members[c.FoldCase(nick)]; ok {
+				symbol := features.PrefixSymbols[strings.IndexRune(features.PrefixModes, mode)]
+				member.Prefixes = setPrefix(member.Prefixes, symbol, adding, features.PrefixSymbols)
+			}
+		case strings.ContainsRune(features.ChanModes[0], mode):
+			nextArg()
+		case strings.ContainsRune(features.ChanModes[1], mode):
+			arg := nextArg()
+			if adding {
+				ch.modes[string(mode)] = arg
+			} else {
+				delete(ch.modes, string(mode))
+			}
+		case strings.ContainsRune(features.ChanModes[2], mode):
+			if adding {
+				ch.modes[string(mode)] = nextArg()
+			} else {
+				delete(ch.modes, string(mode))
+			}
+		default:
+			if adding {
+				ch.modes[string(mode)] = ""
+			} else {
+				delete(ch.modes, string(mode))
+			}
+		}
+	}
+}
+
+// setPrefix adds or removes symbol from prefixes, keeping them ordered by
+// rank as given in symbols.
+func setPrefix(prefixes string, symbol byte, adding bool, symbols string) string {
+	var out []byte
+	for i := 0; i < len(symbols); i++ {
+		s := symbols[i]
+		has := strings.IndexByte(prefixes, s) >= 0
+		if s == symbol {
+			has = adding
+		}
+		if has {
+			out = append(out, s)
+		}
+	}
+	return string(out)
+}
+
+func (c *Client) stateNames(_ *Client, m *Message) {
+	// 353 <nick> <symbol> <channel> :[prefix]<nick>{ [prefix]<nick>}
+	symbols := c.Features().PrefixSymbols
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	ch := c.channelState(m.Param(2))
+	if ch == nil {
+		return
+	}
+	if ch.names == nil {
+		ch.names = make(map[string]*Member)
+	}
+	for _, name := range strings.Fields(m.Param(3)) {
+		i := 0
+		for i < len(name) && strings.IndexByte(symbols, name[i]) >= 0 {
+			i++
+		}
+		// Sort the prefixes by rank; with multi-prefix there may be several.
+		var prefixes string
+		for j := 0; j < i; j++ {
+			prefixes = setPrefix(prefixes, name[j], true, symbols)
+		}
+		src := parseSource(name[i:])
+		ch.names[c.FoldCase(src.Nick)] = &Member{Nick: src.Nick, User: src.User, Host: src.Host, Prefixes: prefixes}
+	}
+}
+
+func (c *Client) stateEndOfNames(_ *Client, m *Message) {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	if ch := c.channelState(m.Param(1)); ch != nil && ch.names != nil {
+		// NAMES does not include accounts; keep those already known.
+		for key, member := range ch.names {
+			if old, ok := ch.members[key]; ok {
+				member.Account = old.Account
+			}
+		}
+		ch.members = ch.names
+		ch.names = nil
+	}
+}
+
+// Channels returns the names of the channels the client is in.
+func (c *Client) Channels() []string {
+	c.stateMu.RLock()
+	defer c.stateMu.RUnlock()
+	var names []string
+	for _, ch := range c.channels {
+		names = append(names, ch.name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Channel returns a snapshot of the named channel's state.
+func (c *Client) Channel(name string) (ChannelState, bool) {
+	c.stateMu.RLock()
+	defer c.stateMu.RUnlock()
+	ch := c.channelState(name)
+	if ch == nil {
+		return ChannelState{}, false
+	}
+	state := ChannelState{
+		Name:  ch.name,
+		Topic: ch.topic,
+		Modes: make(map[string]string, len(ch.modes)),
+	}
+	for mode, arg := range ch.modes {
+		state.Modes[mode] = arg
+	}
+	for _, member := range ch.members {
+		state.Members = append(state.Members, *member)
+	}
+	sort.Slice(state.Members, func(i, j int) bool { return state.Members[i].Nick < state.Members[j].Nick })
+	return state, true
+}
+
+// Members returns the members of a channel the client is in.
+func (c *Client) Members(channel string) []Member {
+	state, _ := c.Channel(channel)
+	return state.Members
+}
+
+func (c *Client) member(channel, nick string) (Member, bool) {
+	c.stateMu.RLock()
+	defer c.stateMu.RUnlock()
+	if ch := c.channelState(channel); ch != nil {
+		if member, ok := ch.members[c.FoldCase(nick)]; ok {
+			return *member, true
+		}
+	}
+	return Member{}, false
+}
+
+// AccountOf returns the services account of nick as learnt from the
+// channels shared with it, or "" if it is not known.
+func (c *Client) AccountOf(nick string) string {
+	key := c.FoldCase(nick)
+	c.stateMu.RLock()
+	defer c.stateMu.RUnlock()
+	for _, ch := range c.channels {
+		if member, ok := ch.members[key]; ok && member.Account != "" {
+			return member.Account
+		}
+	}
+	return ""
+}
+
+// IsPresent reports whether nick is in channel.
+func (c *Client) IsPresent(channel, nick string) bool {
+	_, ok := c.member(channel, nick)
+	return ok
+}
+
+// IsOp reports whether nick has operator status (@) or higher in channel.
+func (c *Client) IsOp(channel, nick string) bool {
+	return c.hasRank(channel, nick, 'o')
+}
+
+// IsVoiced reports whether nick has voice (+) or higher in channel.
+func (c *Client) IsVoiced(channel, nick string) bool {
+	return c.hasRank(channel, nick, 'v')
+}
+
+// hasRank reports whether nick holds the prefix for mode or a higher one.
+func (c *Client) hasRank(channel, nick string, mode byte) bool {
+	member, ok := c.member(channel, nick)
+	if !ok || member.Prefixes == "" {
+		return false
+	}
+	features := c.Features()
+	rank := strings.IndexByte(features.PrefixModes, mode)
+	if rank < 0 {
+		return false
+	}
+	highest := strings.IndexByte(features.PrefixSymbols, member.Prefixes[0])
+	return highest >= 0 && highest <= rank
+}
@@ -0,0 +1,115 @@
+package irc
+
+import (
+	"testing"
+)
+
+func feed(t *testing.T, c *Client, lines ...string) {
+	for _, line := range lines {
+		m, err := ParseMessage(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.dispatch(m)
+	}
+}
+
+func TestChannelState(t *testing.T) {
+	c := New(nil)
+	c.nick = "shelbot"
+
+	feed(t, c,
+		":irc.example.net 005 shelbot PREFIX=(qov)~@+ CHANMODES=b,k,l,nt :are supported by this server",
+		":shelbot!~shel@example.com JOIN #shelly",
+		":irc.example.net 332 shelbot #shelly :Bazinga",
+		":irc.example.net 353 shelbot = #shelly :shelbot ~@leonard +penny raj",
+		":irc.example.net 366 shelbot #shelly :End of /NAMES list.",
+		":leonard!~leo@example.com MODE #shelly +ov-q+lk raj penny leonard 10 key",
+		":howard!~how@example.com JOIN #shelly",
+		":raj!~raj@example.com NICK koothrappali",
+		":leonard!~leo@example.com KICK #shelly howard :out",
+	)
+
+	state, ok := c.Channel("#Shelly")
+	if !ok {
+		t.Fatal("channel #shelly not tracked")
+	}
+	if state.Topic != "Bazinga" {
+		t.Fatalf("topic = %q", state.Topic)
+	}
+	if state.Modes["l"] != "10" || state.Modes["k"] != "key" {
+		t.Fatalf("modes = %v", state.Modes)
+	}
+
+	want := map[string]string{"shelbot": "", "leonard": "@", "penny": "+", "koothrappali": "@"}
+	if len(state.Members) != len(want) {
+		t.Fatalf("members = %v", state.Members)
+	}
+	for _, m := range state.Members {
+		if prefixes, ok := want[m.Nick]; !ok || prefixes != m.Prefixes {
+			t.Fatalf("unexpected member %+v", m)
+		}
+	}
+
+	if !c.IsOp("#shelly", "KOOTHRAPPALI") || c.IsOp("#shelly", "penny") || !c.IsVoiced("#shelly", "penny") {
+		t.Fatal("wrong op/voice status")
+	}
+	if c.IsPresent("#shelly", "howard") {
+		t.Fatal("howard was kicked")
+	}
+
+	feed(t, c, ":shelbot!~shel@example.com PART #shelly")
+	if _, ok := c.Channel("#shelly"); ok {
+		t.Fatal("channel still tracked after parting")
+	}
+}
+
+func TestFoldCase(t *testing.T) {
+	tests := []struct {
+		mapping, a, b string
+		equal         bool
+	}{
+		{CaseMappingRFC1459, "Shel[bot]^", "shel{bot}~", true},
+		{CaseMappingStrictRFC1459, "Shel[bot]", "shel{bot}", true},
+		{CaseMappingStrictRFC1459, "shel^", "shel~", false},
+		{CaseMappingASCII, "Shel[bot]", "shel{bot}", false},
+		{CaseMappingASCII, "SHELBOT", "shelbot", true},
+	}
+	for _, tt := range tests {
+		if got := FoldCase(tt.mapping, tt.a) == FoldCase(tt.mapping, tt.b); got != tt.equal {
+			t.Fatalf("%s: %q == %q is %v, want %v", tt.mapping, tt.a, tt.b, got, tt.equal)
+		}
+	}
+}
+
+func TestAccountTracking(t *testing.T) {
+	c := New(nil)
+	c.nick = "shelbot"
+
+	feed(t, c,
+		":shelbot!~shel@example.com JOIN #shelly shelbot :Shel Bot",
+		":leonard!~leo@example.com JOIN #shelly leonard :Leonard",
+		":penny!~penny@example.com JOIN #shelly * :Penny",
+		":irc.example.net 353 shelbot = #shelly :shelbot leonard penny",
+		":irc.example.net 366 shelbot #shelly :End of /NAMES list.",
+		":penny!~penny@example.com ACCOUNT penny",
+		":leonard!~leo@example.com NICK hofstadter",
+		"@account=raj :raj!~raj@example.com JOIN #shelly",
+	)
+
+	for nick, want := range map[string]string{
+		"hofstadter": "leonard",
+		"PENNY":      "penny",
+		"raj":        "raj",
+		"howard":     "",
+	} {
+		if got := c.AccountOf(nick); got != want {
+			t.Errorf("AccountOf(%q) = %q, want %q", nick, got, want)
+		}
+	}
+
+	feed(t, c, ":penny!~penny@example.com ACCOUNT *")
+	if got := c.AccountOf("penny"); got != "" {
+		t.Errorf("AccountOf(penny) = %q after logging out", got)
+	}
+}
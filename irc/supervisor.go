@@ -0,0 +1,179 @@
+package irc
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"time"
+)
+
+// ChannelKey is a channel to join together with its key, if any.
+type ChannelKey struct {
+	Name string
+	Key  string
+}
+
+type ConnEventType int
+
+const (
+	EventConnecting ConnEventType = iota
+	EventConnected
+	EventRegistered
+	EventDisconnected
+)
+
+func (t ConnEventType) String() string {
+	switch t {
+	case EventConnecting:
+		return "connecting"
+	case EventConnected:
+		return "connected"
+	case EventRegistered:
+		return "registered"
+	case EventDisconnected:
+		return "disconnected"
+	}
+	return "unknown"
+}
+
+// ConnEvent describes a change in the state of a supervised connection.
+type ConnEvent struct {
+	Type ConnEventType
+	// Attempt counts consecutive failed connection attempts.
+	Attempt int
+	// Err is the reason for an EventDisconnected.
+	Err error
+	// Delay is how long the supervisor waits before reconnecting after an
+	// EventDisconnected.
+	Delay time.Duration
+}
+
+// Supervisor keeps a Client connected, reconnecting with exponential backoff
+// whenever the connection is lost and rejoining Channels once registered.
+type Supervisor struct {
+	Client   *Client
+	Dial     func(ctx context.Context) (io.ReadWriter, error)
+	Nick     string
+	RealName string
+	Channels []ChannelKey
+
+	// MinBackoff and MaxBackoff bound the delay between reconnection
+	// attempts. They default to 2 seconds and 5 minutes.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// OnEvent, if set, is called synchronously for every lifecycle event.
+	OnEvent func(ConnEvent)
+}
+
+// Run connects and keeps the client connected until Quit is called on it,
+// in which case it returns nil, ctx is cancelled, in which case it returns
+// ctx.Err(), or a non-recoverable error occurs. The client's message channels
+// are closed as described for Client.Run.
+func (s *Supervisor) Run(ctx context.Context) error {
+	go s.Client.deliver(ctx.Done())
+	defer s.Client.closeChannels(ctx)
+
+	attempt := 0
+	for {
+		s.emit(ConnEvent{Type: EventConnecting, Attempt: attempt})
+		registered, err := s.session(ctx)
+		if s.Client.quitting() {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if _, ok := err.(*SASLError); ok {
+			return err
+		}
+
+		if registered {
+			attempt = 0
+		}
+		attempt++
+		delay := s.backoff(attempt)
+		s.Client.logger.Printf("Disconnected (%v), reconnecting in %s", err, delay)
+		s.emit(ConnEvent{Type: EventDisconnected, Attempt: attempt, Err: err, Delay: delay})
+
+		select {
+		case <-time.After(delay):
+		case <-s.Client.quit:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// session runs a single connection until it fails. It reports whether the
+// client got as far as registering. The client has stopped reading from the
+// connection by the time session returns.
+func (s *Supervisor) session(ctx context.Context) (bool, error) {
+	conn, err := s.Dial(ctx)
+	if err != nil {
+		return false, err
+	}
+	if closer, ok := conn.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	s.Client.reset(conn)
+	s.emit(ConnEvent{Type: EventConnected})
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	listenErr := make(chan error, 1)
+	go func() { listenErr <- s.Client.listen(ctx) }()
+	stop := func(err error) error {
+		cancel()
+		<-listenErr
+		return err
+	}
+
+	if err := s.Client.Connect(s.Nick, s.RealName); err != nil {
+		return false, stop(err)
+	}
+
+	select {
+	case <-s.Client.Registered():
+	case err := <-listenErr:
+		return false, err
+	}
+
+	for _, ch := range s.Channels {
+		if err := s.Client.Join(ch.Name, ch.Key); err != nil {
+			return true, stop(err)
+		}
+	}
+	s.emit(ConnEvent{Type: EventRegistered})
+
+	return true, <-listenErr
+}
+
+func (s *Supervisor) backoff(attempt int) time.Duration {
+	min, max := s.MinBackoff, s.MaxBackoff
+	if min <= 0 {
+		min = 2 * time.Second
+	}
+	if max <= 0 {
+		max = 5 * time.Minute
+	}
+
+	delay := min
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	// Wait somewhere between half and the full delay so that many clients
+	// disconnected at once do not reconnect in lockstep.
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+func (s *Supervisor) emit(e ConnEvent) {
+	if s.OnEvent != nil {
+		s.OnEvent(e)
+	}
+}
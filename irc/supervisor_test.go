@@ -0,0 +1,133 @@
+package irc_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/davidjpeacock/shelbot/irc"
+	"github.com/davidjpeacock/shelbot/irc/irctest"
+)
+
+// supervise runs a Supervisor for client, connecting with dial, and returns
+// the events it emits. The supervisor is stopped when the test ends.
+func supervise(t *testing.T, client *irc.Client, dial func(context.Context) (io.ReadWriter, error)) (<-chan irc.ConnEvent, <-chan error) {
+	t.Helper()
+	events := make(chan irc.ConnEvent, 100)
+	s := &irc.Supervisor{
+		Client:     client,
+		Dial:       dial,
+		Nick:       "shelbot",
+		RealName:   "Shel Bot",
+		Channels:   []irc.ChannelKey{{Name: "#shelbot", Key: "s3cret"}},
+		MinBackoff: 10 * time.Millisecond,
+		MaxBackoff: 40 * time.Millisecond,
+		OnEvent:    func(e irc.ConnEvent) { events <- e },
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- s.Run(context.Background()) }()
+	t.Cleanup(func() { client.Quit("") })
+	return events, errc
+}
+
+// nextEvent returns the next event, failing the test if none arrives.
+func nextEvent(t *testing.T, events <-chan irc.ConnEvent) irc.ConnEvent {
+	t.Helper()
+	select {
+	case e := <-events:
+		return e
+	case <-time.After(2 * time.Second):
+		t.Fatal("no event")
+	}
+	return irc.ConnEvent{}
+}
+
+func TestSupervisorReconnect(t *testing.T) {
+	servers := make(chan *irctest.Server, 2)
+	client := irc.New(nil)
+	events, errc := supervise(t, client, func(context.Context) (io.ReadWriter, error) {
+		server, conn := irctest.NewServer(t)
+		servers <- server
+		return conn, nil
+	})
+
+	for i := 0; i < 2; i++ {
+		server := <-servers
+		server.Register()
+		server.Expect("JOIN", "#shelbot", "s3cret")
+		for _, want := range []irc.ConnEventType{irc.EventConnecting, irc.EventConnected, irc.EventRegistered} {
+			if e := nextEvent(t, events); e.Type != want {
+				t.Fatalf("connection %d: got event %v, want %v", i+1, e.Type, want)
+			}
+		}
+		if i == 0 {
+			server.Close()
+			if e := nextEvent(t, events); e.Type != irc.EventDisconnected || e.Attempt != 1 || e.Err == nil {
+				t.Fatalf("got event %+v, want the first disconnection", e)
+			}
+		}
+	}
+
+	client.Quit("")
+	if err := <-errc; err != nil {
+		t.Errorf("Run returned %v", err)
+	}
+}
+
+func TestSupervisorBackoff(t *testing.T) {
+	client := irc.New(nil)
+	events, errc := supervise(t, client, func(context.Context) (io.ReadWriter, error) {
+		return nil, errors.New("connection refused")
+	})
+
+	// Delays double from MinBackoff up to MaxBackoff, less up to half for
+	// jitter.
+	for attempt, max := range []time.Duration{10, 20, 40, 40} {
+		max *= time.Millisecond
+		e := nextEvent(t, events)
+		for e.Type != irc.EventDisconnected {
+			e = nextEvent(t, events)
+		}
+		if e.Attempt != attempt+1 || e.Delay < max/2 || e.Delay > max {
+			t.Errorf("attempt %d: got %+v, want a delay between %s and %s", attempt+1, e, max/2, max)
+		}
+	}
+
+	client.Quit("")
+	if err := <-errc; err != nil {
+		t.Errorf("Run returned %v", err)
+	}
+}
+
+func TestSupervisorSASLFailure(t *testing.T) {
+	dials := 0
+	server, conn := irctest.NewServer(t)
+	client := irc.New(nil, irc.WithSASLPlain("shelbot", "wrong"))
+	_, errc := supervise(t, client, func(context.Context) (io.ReadWriter, error) {
+		dials++
+		return conn, nil
+	})
+
+	server.Expect("CAP", "LS")
+	server.Sendf(":%s CAP * LS :sasl", irctest.ServerName)
+	server.Expect("CAP", "REQ", "sasl")
+	server.Sendf(":%s CAP * ACK :sasl", irctest.ServerName)
+	server.Expect("AUTHENTICATE", "PLAIN")
+	server.Send("AUTHENTICATE +")
+	server.Expect("AUTHENTICATE")
+	server.Numeric(904, "SASL authentication failed")
+
+	select {
+	case err := <-errc:
+		if _, ok := err.(*irc.SASLError); !ok {
+			t.Errorf("Run returned %v, want a *SASLError", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Run kept trying after SASL failed")
+	}
+	if dials != 1 {
+		t.Errorf("dialled %d times, want 1", dials)
+	}
+}
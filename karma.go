@@ -5,27 +5,45 @@ import (
 	"io"
 	"log"
 	"os"
+	"sync"
 )
 
 type karma struct {
+	mu     sync.Mutex
 	db     map[string]int
 	dbFile io.ReadWriteSeeker
 }
 
 func (k *karma) increment(item string) int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
 	k.db[item]++
 	return k.db[item]
 }
 
 func (k *karma) decrement(item string) int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
 	k.db[item]--
 	return k.db[item]
 }
 
 func (k *karma) query(item string) int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
 	return k.db[item]
 }
 
+func (k *karma) pairs() []Pair {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	var p []Pair
+	for key, value := range k.db {
+		p = append(p, Pair{key, value})
+	}
+	return p
+}
+
 func newKarma(d io.ReadWriteSeeker) *karma {
 	k := &karma{
 		db:     make(map[string]int),
@@ -36,6 +54,8 @@ func newKarma(d io.ReadWriteSeeker) *karma {
 }
 
 func (k *karma) read() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
 	if _, err := k.dbFile.Seek(io.SeekStart, 0); err != nil {
 		return err
 	}
@@ -74,6 +94,8 @@ func readKarmaFileJSON(fileLoc string) (*karma, error) {
 }
 
 func (k *karma) save() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
 	marshaledKarmaData, err := json.MarshalIndent(k.db, "", "    ")
 	if err != nil {
 		return err
@@ -1,30 +1,29 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
-	"net"
 	"os"
 	"os/signal"
 	"os/user"
 	"path/filepath"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/davidjpeacock/shelbot/irc"
+	"github.com/traherom/memstream"
 )
 
 const Version = "2.5.3"
 
 var (
-	homeDir string
-	bot     *config
-	client  *irc.Client
-	k       *karma
-	apiKey  string
-	limits  = make(map[string]time.Time)
+	homeDir   string
+	apiKey    string
+	startTime = time.Now()
 )
 
 func init() {
@@ -50,6 +49,8 @@ func main() {
 	v := flag.Bool("v", false, "Prints Shelbot version")
 	airportFile := flag.String("airportFile", filepath.Join(homeDir, "airports.csv"), "airport data csv file")
 	flag.StringVar(&apiKey, "forecastioKey", "", "Forcast.io API key")
+	recordDir := flag.String("record", "", "directory to record raw IRC traffic to, one file per network")
+	replayFile := flag.String("replay", "", "recorded IRC session to play back instead of connecting")
 	flag.Parse()
 
 	logger := log.New(os.Stdout, "IRC: ", log.LstdFlags)
@@ -72,107 +73,148 @@ func main() {
 		return
 	}
 
-	if bot, err = loadConfig(*confFile); err != nil {
+	bot, err := loadConfig(*confFile)
+	if err != nil {
 		log.Fatalf("Error reading config file: %s", err)
 	}
 
-	if k, err = readKarmaFileJSON(*karmaFile); err != nil {
-		log.Fatalf("Error loading karma DB: %s", err)
+	var replay *irc.Replay
+	if *replayFile != "" {
+		if bot.Networks, replay, err = loadReplay(*replayFile, bot.Networks); err != nil {
+			log.Fatalf("Error loading recording: %s", err)
+		}
 	}
 
-	netConn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", bot.Server, bot.Port))
+	open := readKarmaFileJSON
+	if replay != nil {
+		// Replays start from empty karma so that they are reproducible
+		// and leave the real karma alone.
+		open = func(string) (*karma, error) { return newKarma(memstream.New()), nil }
+	}
+	karmas, err := openKarma(bot.Networks, *karmaFile, open)
 	if err != nil {
-		log.Fatalf("Failed to connect to IRC server: %s", err)
+		log.Fatalf("Error loading karma DB: %s", err)
 	}
-	defer netConn.Close()
 
-	log.Println("Connected to IRC server", fmt.Sprintf("%s:%d", bot.Server, bot.Port), netConn.RemoteAddr())
-
-	client = irc.New(netConn,
-		irc.WithPause(500*time.Millisecond),
-		irc.WithLogger(logger))
-
-	if err = client.Connect(bot.Nick, bot.User); err != nil {
-		log.Fatal(err)
+	var networks []*network
+	for i, cfg := range bot.Networks {
+		netLogger := log.New(logger.Writer(), fmt.Sprintf("IRC %s: ", cfg.Name), log.LstdFlags)
+		var opts []irc.Option
+		if *recordDir != "" {
+			f, err := os.OpenFile(filepath.Join(*recordDir, cfg.Name+".irc"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+			if err != nil {
+				log.Fatalf("Error opening recording: %s", err)
+			}
+			defer f.Close()
+			opts = append(opts, irc.WithRecorder(f))
+		}
+		if replay != nil {
+			opts = append(opts, irc.WithRateLimit(1, 0))
+			// Recorded messages are old by the time they are replayed.
+			cfg.MaxAge = -1
+		}
+		networks = append(networks, newNetwork(cfg, karmas[i], netLogger, replay, opts...))
 	}
 
+	// Networks that are connected quit gracefully; cancelling the context
+	// stops those that are still dialing or waiting to reconnect.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	go func() {
 		c := make(chan os.Signal, 1)
 		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 		<-c
 		log.Println("Received SIGTERM, exiting")
-		if err := client.Quit("Bazinga!"); err != nil {
-			log.Printf("Could not exit gracefully: %v", err)
+		for _, n := range networks {
+			if err := n.client.Quit("Bazinga!"); err != nil {
+				log.Printf("Could not exit %s gracefully: %v", n.cfg.Name, err)
+			}
 		}
+		cancel()
 	}()
 
-	if err := client.Join(bot.Channel, ""); err != nil {
-		log.Fatalf("could not join channel: %v", err)
-	}
-	err = client.Send(bot.Channel, fmt.Sprintf("%s version %s reporting for duty", bot.Nick, Version))
-	if err != nil {
-		log.Fatalf("Could not send hello: %v", err)
+	var wg sync.WaitGroup
+	errs := make(chan error, len(networks))
+	for _, n := range networks {
+		wg.Add(1)
+		go func(n *network) {
+			defer wg.Done()
+			if err := n.run(ctx); err != nil && err != context.Canceled {
+				log.Printf("Network %s stopped: %v", n.cfg.Name, err)
+				errs <- err
+			}
+		}(n)
 	}
+	wg.Wait()
+	close(errs)
 
-	go handleMessages(client.PrivateMessages())
-
-	listenErr := client.Listen()
-	if err = k.save(); err == nil {
-		if f, ok := k.dbFile.(*os.File); ok {
-			f.Close()
+	saved := make(map[*karma]bool)
+	for _, k := range karmas {
+		if saved[k] {
+			continue
+		}
+		saved[k] = true
+		if err := k.save(); err == nil {
+			if f, ok := k.dbFile.(*os.File); ok {
+				f.Close()
+			}
 		}
 	}
 
-	if listenErr != nil {
+	if err, ok := <-errs; ok {
 		log.Fatal(err)
 	}
-}
 
-func handleMessages(msgs <-chan *irc.PrivateMessage) {
-	for msg := range msgs {
-		lineElements := strings.Fields(msg.Text)
-
-		if lineElements[0] == bot.Nick {
-			if commandFunc, ok := commands[lineElements[1]]; ok {
-				msg.Text = strings.Join(lineElements[1:], " ")
-				commandFunc(msg)
-			}
-
-			continue
-		}
-
-		if commandFunc, ok := commands[lineElements[0]]; ok && !strings.HasPrefix(msg.Channel, "#") {
-			commandFunc(msg)
-			continue
+	if replay != nil {
+		for _, line := range replay.Written() {
+			fmt.Println(line)
 		}
+	}
+}
 
-		var handle string
-		var karmaFunc func(string) int
-		switch {
-		case strings.HasSuffix(msg.Text, "++"):
-			handle = strings.TrimSuffix(lineElements[len(lineElements)-1], "++")
-			karmaFunc = k.increment
-		case strings.HasSuffix(msg.Text, "--"):
-			handle = strings.TrimSuffix(lineElements[len(lineElements)-1], "--")
-			karmaFunc = k.decrement
-		default:
-			continue
+// openKarma opens the karma DB of each network with open. Networks without
+// their own karma file use defaultFile, and networks using the same file
+// share one DB.
+func openKarma(networks []*networkConfig, defaultFile string, open func(string) (*karma, error)) ([]*karma, error) {
+	stores := make(map[string]*karma)
+	karmas := make([]*karma, len(networks))
+	for i, cfg := range networks {
+		file := cfg.KarmaFile
+		if file == "" {
+			file = defaultFile
 		}
-		if lastK, ok := limits[msg.User]; (ok && lastK.Add(60*time.Second).Before(time.Now())) || !ok {
-			karmaTotal := karmaFunc(handle)
-			response := fmt.Sprintf("Karma for %s now %d", handle, karmaTotal)
-			if err := client.Send(msg.ReplyChannel, response); err != nil {
-				log.Printf("Could not send message: %v", err)
-				continue
+		k, ok := stores[file]
+		if !ok {
+			var err error
+			if k, err = open(file); err != nil {
+				return nil, err
 			}
-			log.Println(response)
+			stores[file] = k
+		}
+		karmas[i] = k
+	}
+	return karmas, nil
+}
 
-			if err := k.save(); err != nil {
-				log.Fatalf("Error saving karma db: %s", err)
-			}
-			limits[msg.User] = time.Now()
-		} else if !lastK.Add(60 * time.Second).Before(time.Now()) {
-			log.Println(msg.Nick, "has already sent a karma message in the last 60 seconds")
+// loadReplay reads a recording made with -record. It is played back to the
+// network named after the file, e.g. "freenode" for freenode.irc, or the
+// first network if there is no such network.
+func loadReplay(path string, networks []*networkConfig) ([]*networkConfig, *irc.Replay, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	replay, err := irc.NewReplay(f)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	for _, cfg := range networks {
+		if cfg.Name == name {
+			return []*networkConfig{cfg}, replay, nil
 		}
 	}
+	return networks[:1], replay, nil
 }
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/davidjpeacock/shelbot/irc"
+	"github.com/davidjpeacock/shelbot/irc/format"
+)
+
+// replyTimeout is how long a reply may wait in the send queue, e.g. behind
+// flood control, before it is dropped as stale.
+const replyTimeout = time.Minute
+
+// network is a connection to a single IRC network along with the state the
+// bot keeps for it.
+type network struct {
+	cfg     *networkConfig
+	client  *irc.Client
+	karma   *karma
+	limits  map[string]time.Time
+	greeted bool
+	// dial opens the connection to the server; tests replace it.
+	dial func(ctx context.Context) (io.ReadWriter, error)
+	// ctx is the context passed to run, which bounds everything sent.
+	ctx context.Context
+	// replay, if set, is played back to the bot instead of connecting.
+	replay *irc.Replay
+}
+
+// newNetwork sets up a network. If replay is not nil the network plays it
+// back instead of connecting to the server. Any extra options are passed on
+// to the client.
+func newNetwork(cfg *networkConfig, k *karma, logger *log.Logger, replay *irc.Replay, extra ...irc.Option) *network {
+	opts := []irc.Option{
+		irc.WithLogger(logger),
+		irc.WithKeepalive(2*time.Minute, time.Minute),
+		irc.WithMaxLines(cfg.MaxLines),
+		irc.WithSendTimeout(replyTimeout),
+		irc.WithAltNicks(cfg.AltNicks...),
+		irc.WithVersion("shelbot " + Version),
+		irc.WithStripFormatting(),
+		irc.WithCapabilities(
+			irc.CapServerTime,
+			irc.CapAccountTag,
+			irc.CapAccountNotify,
+			irc.CapMessageTags,
+			irc.CapMultiPrefix,
+			irc.CapAwayNotify,
+			irc.CapExtendedJoin,
+			irc.CapBatch,
+		),
+	}
+	opts = append(opts, cfg.authOptions()...)
+	opts = append(opts, cfg.inboxOption()...)
+
+	var conn io.ReadWriter
+	if replay != nil {
+		conn = replay
+	}
+	n := &network{
+		cfg:    cfg,
+		client: irc.New(conn, append(opts, extra...)...),
+		karma:  k,
+		limits: make(map[string]time.Time),
+		ctx:    context.Background(),
+		replay: replay,
+	}
+	n.dial = n.dialServer
+	return n
+}
+
+// dialServer connects to the configured server.
+func (n *network) dialServer(ctx context.Context) (io.ReadWriter, error) {
+	conn, err := n.cfg.dialer().DialContext(ctx, n.cfg.address())
+	if err != nil {
+		return nil, err
+	}
+	log.Println("Connected to IRC server", n.cfg.address(), conn.RemoteAddr())
+	return conn, nil
+}
+
+// run keeps the network connected until the client quits or ctx is
+// cancelled, and returns once all received messages have been handled. When
+// replaying it returns once the replies to the whole recording are written.
+func (n *network) run(ctx context.Context) error {
+	n.ctx = ctx
+	supervisor := &irc.Supervisor{
+		Client:   n.client,
+		Nick:     n.cfg.Nick,
+		RealName: n.cfg.User,
+		Channels: n.cfg.channelKeys(),
+		Dial:     n.dial,
+		OnEvent:  n.connectionEvent,
+	}
+
+	n.client.OnNotice(n.notice)
+
+	handled := make(chan struct{})
+	go func() {
+		n.handleMessages(n.client.PrivateMessages())
+		close(handled)
+	}()
+
+	var err error
+	if n.replay != nil {
+		if err = n.client.Run(ctx); err == io.EOF {
+			err = nil
+		}
+	} else {
+		err = supervisor.Run(ctx)
+	}
+	<-handled
+	if n.replay != nil && err == nil {
+		err = n.client.Flush(ctx)
+	}
+	return err
+}
+
+// connectionEvent is called by the supervisor as the IRC connection goes up
+// and down. The greeting is only sent the first time the bot registers so
+// that reconnects do not spam the channel.
+func (n *network) connectionEvent(e irc.ConnEvent) {
+	switch e.Type {
+	case irc.EventRegistered:
+		log.Printf("Registered with %s, capabilities: %v", n.cfg.Name, n.client.Capabilities())
+		if n.greeted {
+			return
+		}
+		n.greeted = true
+		for _, ch := range n.cfg.Channels {
+			greeting := fmt.Sprintf("%s version %s reporting for duty", n.client.Nick(), Version)
+			if ch.Greeting != nil {
+				greeting = *ch.Greeting
+			}
+			if greeting == "" {
+				continue
+			}
+			if err := n.client.Send(n.ctx, ch.Name, greeting); err != nil {
+				log.Printf("Could not send hello: %v", err)
+			}
+		}
+	case irc.EventDisconnected:
+		log.Printf("Lost connection to %s: %v (attempt %d, retrying in %s)", n.cfg.Name, e.Err, e.Attempt, e.Delay)
+	}
+}
+
+// channel returns the settings for the named channel, or nil if it is not a
+// configured channel. Names are compared using the server's case mapping.
+func (n *network) channel(name string) *channelConfig {
+	for _, ch := range n.cfg.Channels {
+		if n.client.EqualFold(ch.Name, name) {
+			return ch
+		}
+	}
+	return nil
+}
+
+// reply answers msg, by NOTICE if the network is configured for it, as part
+// of its thread where the server supports it. The reply is dropped if it
+// cannot be sent within replyTimeout.
+func (n *network) reply(msg *irc.PrivateMessage, text string) error {
+	if n.cfg.Notice {
+		return n.client.Notice(n.ctx, msg.ReplyChannel, text, irc.ReplyTo(msg.ID))
+	}
+	return n.client.Send(n.ctx, msg.ReplyChannel, text, irc.ReplyTo(msg.ID))
+}
+
+// identity returns who sent msg for rate limiting: the services account if
+// the sender is logged in, which stays the same across nicks and hosts, or
+// else their user@host.
+func identity(msg *irc.PrivateMessage) string {
+	if msg.Account != "" {
+		return "account:" + msg.Account
+	}
+	return "host:" + msg.User
+}
+
+// isSender reports whether name refers to the sender of msg, by nick or by
+// services account.
+func (n *network) isSender(msg *irc.PrivateMessage, name string) bool {
+	return n.client.EqualFold(name, msg.Nick) || (msg.Account != "" && strings.EqualFold(name, msg.Account))
+}
+
+// colored returns s in color c, unless colors are disabled.
+func (n *network) colored(s string, c format.Color) string {
+	if !n.cfg.colorsEnabled() {
+		return s
+	}
+	return format.Colored(s, c)
+}
+
+// notice logs notices, such as those from NickServ. They are never answered
+// to avoid loops with other bots.
+func (n *network) notice(_ *irc.Client, e *irc.Notice) {
+	log.Printf("Notice from %s to %s: %s", e.Source.Nick, e.Target, e.Text)
+}
+
+func (n *network) handleMessages(msgs <-chan *irc.PrivateMessage) {
+	for msg := range msgs {
+		// CTCP queries are answered by the irc package; actions (/me) may
+		// adjust karma but do not run commands.
+		if msg.CTCP != nil && msg.CTCP.Command != "ACTION" {
+			continue
+		}
+
+		// History played back after reconnecting, e.g. by a bouncer, has
+		// already been acted on.
+		if maxAge := n.cfg.maxAge(); msg.Playback || (maxAge > 0 && time.Since(msg.Time) > maxAge) {
+			log.Printf("Ignoring old message from %s at %s: %s", msg.Nick, msg.Time.Format(time.RFC3339), msg.Text)
+			continue
+		}
+
+		lineElements := strings.Fields(msg.Text)
+		if len(lineElements) == 0 {
+			continue
+		}
+
+		settings := n.channel(msg.Channel)
+
+		if msg.CTCP == nil && n.client.EqualFold(lineElements[0], n.client.Nick()) && len(lineElements) > 1 {
+			if commandFunc, ok := commands[lineElements[1]]; ok && settings.commandEnabled(lineElements[1]) {
+				msg.Text = strings.Join(lineElements[1:], " ")
+				commandFunc(n, msg)
+			}
+
+			continue
+		}
+
+		if commandFunc, ok := commands[lineElements[0]]; ok && msg.CTCP == nil && !n.client.IsChannel(msg.Channel) {
+			commandFunc(n, msg)
+			continue
+		}
+
+		if !settings.karmaEnabled() {
+			continue
+		}
+
+		var handle string
+		var karmaFunc func(string) int
+		var color format.Color
+		switch {
+		case strings.HasSuffix(msg.Text, "++"):
+			handle = strings.TrimSuffix(lineElements[len(lineElements)-1], "++")
+			karmaFunc = n.karma.increment
+			color = format.Green
+		case strings.HasSuffix(msg.Text, "--"):
+			handle = strings.TrimSuffix(lineElements[len(lineElements)-1], "--")
+			karmaFunc = n.karma.decrement
+			color = format.Red
+		default:
+			continue
+		}
+		if color == format.Green && n.isSender(msg, handle) {
+			if err := n.reply(msg, fmt.Sprintf("Nice try, %s.", msg.Nick)); err != nil {
+				log.Printf("Could not send message: %v", err)
+			}
+			log.Println(msg.Nick, "tried to give themselves karma")
+			continue
+		}
+		sender := identity(msg)
+		if lastK, ok := n.limits[sender]; (ok && lastK.Add(60*time.Second).Before(time.Now())) || !ok {
+			karmaTotal := karmaFunc(handle)
+			response := fmt.Sprintf("Karma for %s now %d", handle, karmaTotal)
+			if err := n.reply(msg, fmt.Sprintf("Karma for %s now %s", handle, n.colored(strconv.Itoa(karmaTotal), color))); err != nil {
+				log.Printf("Could not send message: %v", err)
+				continue
+			}
+			log.Println(response)
+
+			if err := n.karma.save(); err != nil {
+				log.Fatalf("Error saving karma db: %s", err)
+			}
+			n.limits[sender] = time.Now()
+		} else if !lastK.Add(60 * time.Second).Before(time.Now()) {
+			log.Println(msg.Nick, "has already sent a karma message in the last 60 seconds")
+		}
+	}
+}
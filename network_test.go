@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/davidjpeacock/shelbot/irc"
+	"github.com/davidjpeacock/shelbot/irc/irctest"
+	"github.com/traherom/memstream"
+)
+
+// startNetwork runs a network configured by the given JSON against a fake
+// server offering caps, and waits for it to join its channels.
+func startNetwork(t *testing.T, conf string, caps ...string) (*network, *irctest.Server) {
+	t.Helper()
+	cfg := &networkConfig{}
+	if err := json.Unmarshal([]byte(conf), cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	server, conn := irctest.NewServer(t)
+	server.Caps = caps
+	n := newNetwork(cfg, newKarma(memstream.New()), log.New(ioutil.Discard, "", 0), nil, irc.WithRateLimit(1, 0))
+	n.dial = func(context.Context) (io.ReadWriter, error) { return conn, nil }
+
+	errc := make(chan error, 1)
+	go func() { errc <- n.run(context.Background()) }()
+	t.Cleanup(func() {
+		n.client.Quit("")
+		if err := <-errc; err != nil {
+			t.Errorf("run returned %v", err)
+		}
+	})
+
+	server.Register()
+	for _, ch := range cfg.Channels {
+		server.Expect("JOIN", ch.Name)
+		server.Join(server.Nick(), ch.Name)
+	}
+	return n, server
+}
+
+func TestKarmaMessages(t *testing.T) {
+	n, server := startNetwork(t, `{"server": "irc.example.net", "nick": "shelbot", "channels": [{"name": "#shelbot", "greeting": ""}]}`)
+
+	server.Privmsg("alice", "#shelbot", "\x02gophers\x02++")
+	server.Expect("PRIVMSG", "#shelbot", "Karma for gophers now \x03031\x03")
+	server.Privmsg("bob", "#shelbot", "well done \x0304gophers\x03++")
+	server.Expect("PRIVMSG", "#shelbot", "Karma for gophers now \x03032\x03")
+	server.Privmsg("carol", "#shelbot", "rust--")
+	server.Expect("PRIVMSG", "#shelbot", "Karma for rust now \x0304-1\x03")
+
+	// alice is rate limited.
+	server.Privmsg("alice", "#shelbot", "rust--")
+	server.Privmsg("alice", "#shelbot", "shelbot query rust")
+	if m := server.Next(); m.Param(1) != "Karma for rust is -1." {
+		t.Errorf("got %q, want the karma for rust", m)
+	}
+
+	if got := n.karma.query("gophers"); got != 2 {
+		t.Errorf("karma for gophers is %d, want 2", got)
+	}
+}
+
+func TestCommands(t *testing.T) {
+	_, server := startNetwork(t, `{"server": "irc.example.net", "nick": "shelbot", "channels": [{"name": "#shelbot"}]}`)
+	server.Expect("PRIVMSG", "#shelbot", "shelbot version "+Version+" reporting for duty")
+
+	server.Privmsg("alice", "#shelbot", "SHELBOT version")
+	server.Expect("PRIVMSG", "#shelbot", "shelbot version "+Version+".")
+
+	// Commands work without addressing the bot in private.
+	server.Privmsg("alice", "shelbot", "version")
+	server.Expect("PRIVMSG", "alice", "shelbot version "+Version+".")
+
+	// But not in channels.
+	server.Privmsg("alice", "#shelbot", "version")
+	server.Privmsg("alice", "#shelbot", "shelbot query nothing")
+	if m := server.Next(); m.Param(1) != "Karma for nothing is 0." {
+		t.Errorf("got %q, want the karma for nothing", m)
+	}
+}
+
+func TestChannelSettings(t *testing.T) {
+	_, server := startNetwork(t, `{
+		"server": "irc.example.net",
+		"nick": "shelbot",
+		"notice": true,
+		"channels": [
+			{"name": "#quiet", "karma": false, "commands": ["version"], "greeting": ""},
+			{"name": "#shelbot", "greeting": "hi"}
+		]
+	}`)
+	server.Expect("PRIVMSG", "#shelbot", "hi")
+
+	server.Privmsg("alice", "#quiet", "gophers++")
+	server.Privmsg("alice", "#quiet", "shelbot query gophers")
+	server.Privmsg("alice", "#quiet", "shelbot version")
+	if m := server.Next(); m.Command != "NOTICE" || m.Param(0) != "#quiet" || m.Param(1) != "shelbot version "+Version+"." {
+		t.Errorf("got %q, want a version NOTICE to #quiet", m)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	colors := false
+	cfg := &networkConfig{Server: "irc.example.net", Nick: "shelbot", Channel: "#shelbot", Pass: "hunter2", Colors: &colors}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	replay, err := irc.NewReplay(strings.NewReader(`2017-03-01T12:00:00.000Z >> CAP LS 302
+2017-03-01T12:00:00.000Z >> NICK shelbot
+2017-03-01T12:00:00.050Z << :irc.example.net CAP * LS :multi-prefix server-time
+2017-03-01T12:00:00.060Z >> CAP REQ :server-time multi-prefix
+2017-03-01T12:00:00.070Z << :irc.example.net CAP * ACK :server-time multi-prefix
+2017-03-01T12:00:00.080Z >> CAP END
+2017-03-01T12:00:00.100Z << :irc.example.net 001 shelbot :Welcome
+2017-03-01T12:00:00.110Z >> PRIVMSG NickServ :<redacted>
+2017-03-01T12:00:01.000Z << :alice!~a@example.com PRIVMSG #shelbot :gophers++
+2017-03-01T12:00:01.100Z >> PRIVMSG #shelbot :Karma for gophers now 1
+2017-03-01T12:00:02.000Z << :bob!~b@example.com PRIVMSG #shelbot :shelbot query gophers
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := newNetwork(cfg, newKarma(memstream.New()), log.New(ioutil.Discard, "", 0), replay, irc.WithRateLimit(1, 0))
+	if err := n.run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"CAP REQ :server-time multi-prefix",
+		"CAP END",
+		"PRIVMSG NickServ :<redacted>",
+		"PRIVMSG #shelbot :Karma for gophers now 1",
+		"PRIVMSG #shelbot :Karma for gophers is 1.",
+	}
+	if got := replay.Written(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("bot sent %q, want %q", got, want)
+	}
+}
+
+func TestIgnoreOldMessages(t *testing.T) {
+	_, server := startNetwork(t, `{"server": "irc.example.net", "nick": "shelbot", "channel": "#shelbot", "colors": false}`)
+	server.Expect("PRIVMSG", "#shelbot")
+
+	server.Sendf("@time=2017-03-01T12:00:00.000Z :%s PRIVMSG #shelbot :stale++", irctest.Mask("alice"))
+	server.Sendf(":%s BATCH +1 znc.in/playback #shelbot", irctest.ServerName)
+	server.Sendf("@batch=1 :%s PRIVMSG #shelbot :replayed++", irctest.Mask("bob"))
+	server.Sendf(":%s BATCH -1", irctest.ServerName)
+	server.Privmsg("carol", "#shelbot", "fresh++")
+	if m := server.Next(); m.Param(1) != "Karma for fresh now 1" {
+		t.Errorf("got %q, want only the fresh message acted on", m)
+	}
+}
+
+func TestAccounts(t *testing.T) {
+	_, server := startNetwork(t, `{"server": "irc.example.net", "nick": "shelbot", "channel": "#shelbot", "colors": false}`)
+	server.Expect("PRIVMSG", "#shelbot")
+
+	// The cooldown follows the account across nicks and hosts.
+	server.Send("@account=alice :alice!~a@one.example.com PRIVMSG #shelbot :gophers++")
+	server.Expect("PRIVMSG", "#shelbot", "Karma for gophers now 1")
+	server.Send("@account=alice :alice_!~a@two.example.com PRIVMSG #shelbot :gophers++")
+
+	server.Send("@account=bob :bobby!~b@example.com PRIVMSG #shelbot :Bob++")
+	if m := server.Next(); m.Param(1) != "Nice try, bobby." {
+		t.Errorf("got %q, want self-karma refused", m)
+	}
+}
+
+func TestThreadedReplies(t *testing.T) {
+	_, server := startNetwork(t, `{"server": "irc.example.net", "nick": "shelbot", "channel": "#shelbot", "colors": false}`, irc.CapMessageTags)
+	server.Expect("PRIVMSG", "#shelbot")
+
+	server.Sendf("@msgid=abc123 :%s PRIVMSG #shelbot :shelbot query gophers", irctest.Mask("alice"))
+	if m := server.Expect("PRIVMSG", "#shelbot", "Karma for gophers is 0."); m.Tags["+draft/reply"] != "abc123" {
+		t.Errorf("got %q, want a reply to abc123", m)
+	}
+
+	// Messages without an ID get a plain reply.
+	server.Privmsg("alice", "#shelbot", "shelbot query gophers")
+	if m := server.Expect("PRIVMSG", "#shelbot", "Karma for gophers is 0."); len(m.Tags) != 0 {
+		t.Errorf("got %q, want no tags", m)
+	}
+}
+
+func TestWhoisCommand(t *testing.T) {
+	_, server := startNetwork(t, `{"server": "irc.example.net", "nick": "shelbot", "channel": "#shelbot", "colors": false}`)
+	server.Expect("PRIVMSG", "#shelbot")
+
+	server.Privmsg("bob", "#shelbot", "shelbot whois alice")
+	server.Expect("WHOIS", "alice")
+	// Karma keeps working while the bot waits for the answer.
+	server.Privmsg("bob", "#shelbot", "gophers++")
+	server.Expect("PRIVMSG", "#shelbot", "Karma for gophers now 1")
+
+	server.Numeric(311, "alice", "~a", "example.com", "*", "Alice Liddell")
+	server.Numeric(330, "alice", "alice", "is logged in as")
+	server.Numeric(319, "alice", "#shelbot")
+	server.Numeric(318, "alice", "End of /WHOIS list")
+	server.Expect("PRIVMSG", "#shelbot", "alice is ~a@example.com (Alice Liddell), logged in as alice, on #shelbot.")
+
+	server.Privmsg("bob", "#shelbot", "shelbot whois nobody")
+	server.Expect("WHOIS", "nobody")
+	server.Numeric(401, "nobody", "No such nick/channel")
+	server.Expect("PRIVMSG", "#shelbot", "Sorry bob, nobody is using the nick nobody.")
+}